@@ -0,0 +1,271 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MetricsAggregator owns the streaming histograms, status-code map and
+// running counters for one load test, updating them from a single
+// goroutine reading off a Result channel. The channel already serializes
+// delivery, so no mutex is needed around that consumption - the mutex
+// below only guards reads of the running totals, which are also read
+// concurrently by /loadtest/stream while the test is still in progress.
+type MetricsAggregator struct {
+	mu sync.Mutex
+
+	serviceHistogram  *HDRHistogram
+	responseHistogram *HDRHistogram
+	serviceDigest     *TDigest
+	responseDigest    *TDigest
+
+	statusMetrics map[int]*StatusCodeMetrics
+
+	errors                    int
+	dropped                   int
+	coordinatedOmissionEvents int
+	minLatency                time.Duration
+	maxLatency                time.Duration
+	sumLatency                time.Duration
+	completed                 int
+
+	// scheduled, dispatched and inflightChan are set by the dispatch loop in
+	// startLoadTest rather than by Run. scheduled counts every arrival the
+	// profile produced (dispatched or dropped) and is the real denominator
+	// for TotalRequests/ErrorRate - rps*duration only equals that for
+	// ConstantRateProfile; ramp/step profiles schedule at their *average*
+	// rate over the run, not their final rps, so precomputing rps*duration
+	// silently over-counts (by up to 2x for a ramp up from near zero) or
+	// under-counts (for a ramp down). dispatched backs the
+	// rolling "requests sent" counter /loadtest/stream reports.
+	scheduled    int64
+	dispatched   int64
+	inflightChan chan struct{}
+
+	done chan struct{}
+}
+
+// NewMetricsAggregator builds an aggregator. When estimator is "tdigest" it
+// also feeds a t-digest alongside the HDR histogram, used in place of the
+// histogram's percentiles for heavy-tailed distributions.
+func NewMetricsAggregator(estimator string) *MetricsAggregator {
+	a := &MetricsAggregator{
+		serviceHistogram:  newLatencyHistogram(),
+		responseHistogram: newLatencyHistogram(),
+		statusMetrics:     make(map[int]*StatusCodeMetrics),
+		minLatency:        time.Duration(math.MaxInt64),
+		done:              make(chan struct{}),
+	}
+	if estimator == "tdigest" {
+		a.serviceDigest = NewTDigest(100)
+		a.responseDigest = NewTDigest(100)
+	}
+	return a
+}
+
+// Run consumes results until the channel is closed, then closes Done().
+// It's meant to run in its own goroutine for the lifetime of a test.
+func (a *MetricsAggregator) Run(results <-chan Result) {
+	defer close(a.done)
+	for result := range results {
+		a.record(result)
+	}
+}
+
+// Done reports when Run has drained every result.
+func (a *MetricsAggregator) Done() <-chan struct{} { return a.done }
+
+func (a *MetricsAggregator) record(result Result) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if result.overdue {
+		a.coordinatedOmissionEvents++
+	}
+	if result.err != nil {
+		a.errors++
+		return
+	}
+
+	a.completed++
+	a.sumLatency += result.latency
+	a.serviceHistogram.Record(result.latency)
+	a.responseHistogram.Record(result.response)
+	if a.serviceDigest != nil {
+		a.serviceDigest.Insert(float64(result.latency))
+		a.responseDigest.Insert(float64(result.response))
+	}
+	if result.latency < a.minLatency {
+		a.minLatency = result.latency
+	}
+	if result.latency > a.maxLatency {
+		a.maxLatency = result.latency
+	}
+
+	sm, ok := a.statusMetrics[result.status]
+	if !ok {
+		sm = &StatusCodeMetrics{MinLatency: time.Duration(math.MaxInt64)}
+		a.statusMetrics[result.status] = sm
+	}
+	sm.Count++
+	sm.SumLatency += result.latency
+	if result.latency < sm.MinLatency {
+		sm.MinLatency = result.latency
+	}
+	if result.latency > sm.MaxLatency {
+		sm.MaxLatency = result.latency
+	}
+}
+
+// RecordDropped counts one scheduled request skipped because max_inflight
+// was already saturated.
+func (a *MetricsAggregator) RecordDropped() {
+	a.mu.Lock()
+	a.dropped++
+	a.mu.Unlock()
+}
+
+// RecordDispatched counts one request handed off to a worker, independent
+// of whether it has completed yet.
+func (a *MetricsAggregator) RecordDispatched() {
+	atomic.AddInt64(&a.dispatched, 1)
+}
+
+// RecordScheduled counts one arrival the profile produced, whether or not
+// it ended up dispatched to a worker.
+func (a *MetricsAggregator) RecordScheduled() {
+	atomic.AddInt64(&a.scheduled, 1)
+}
+
+func (a *MetricsAggregator) statusSnapshotLocked() map[int]*ResponseStatusCodeMetrics {
+	snapshot := make(map[int]*ResponseStatusCodeMetrics, len(a.statusMetrics))
+	for status, metrics := range a.statusMetrics {
+		snapshot[status] = &ResponseStatusCodeMetrics{
+			Count:      metrics.Count,
+			MinLatency: metrics.MinLatency.String(),
+			MaxLatency: metrics.MaxLatency.String(),
+			AvgLatency: (metrics.SumLatency / time.Duration(metrics.Count)).String(),
+		}
+	}
+	return snapshot
+}
+
+// ProgressSnapshot is the rolling-counter event /loadtest/stream emits once
+// a second while a test is still running.
+type ProgressSnapshot struct {
+	RequestsSent int                                `json:"requests_sent"`
+	InFlight     int                                `json:"in_flight"`
+	ErrorRate    float64                            `json:"error_rate"`
+	P50          string                             `json:"p50"`
+	P95          string                             `json:"p95"`
+	P99          string                             `json:"p99"`
+	StatusCodes  map[int]*ResponseStatusCodeMetrics `json:"status_codes"`
+}
+
+// Progress reports the counters as they stand right now; it's safe to call
+// while Run is still consuming results.
+func (a *MetricsAggregator) Progress() ProgressSnapshot {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	sent := atomic.LoadInt64(&a.dispatched)
+	errorRate := 0.0
+	if sent > 0 {
+		errorRate = float64(a.errors) / float64(sent) * 100
+	}
+
+	inFlight := 0
+	if a.inflightChan != nil {
+		inFlight = len(a.inflightChan)
+	}
+
+	return ProgressSnapshot{
+		RequestsSent: int(sent),
+		InFlight:     inFlight,
+		ErrorRate:    errorRate,
+		P50:          a.serviceHistogram.Percentile(50).String(),
+		P95:          a.serviceHistogram.Percentile(95).String(),
+		P99:          a.serviceHistogram.Percentile(99).String(),
+		StatusCodes:  a.statusSnapshotLocked(),
+	}
+}
+
+// Snapshot builds the final LoadTestMetrics once a test has finished, in
+// the same shape LoadTestHandler has always returned. rps comes from the
+// caller purely to report back as RequestsPerSecond; the actual request
+// count is read from a.scheduled (every arrival the profile produced),
+// not recomputed from rps - for non-constant profiles rps*duration is
+// only the *final* rate, not the average the profile actually ran at.
+func (a *MetricsAggregator) Snapshot(rps int) LoadTestMetrics {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	scheduledTotal := int(atomic.LoadInt64(&a.scheduled))
+
+	avgLatency := time.Duration(0)
+	if a.completed > 0 {
+		avgLatency = a.sumLatency / time.Duration(a.completed)
+	}
+
+	p50 := a.serviceHistogram.Percentile(50)
+	p90 := a.serviceHistogram.Percentile(90)
+	p95 := a.serviceHistogram.Percentile(95)
+	p99 := a.serviceHistogram.Percentile(99)
+	p999 := a.serviceHistogram.Percentile(99.9)
+
+	responseP50 := a.responseHistogram.Percentile(50)
+	responseP90 := a.responseHistogram.Percentile(90)
+	responseP95 := a.responseHistogram.Percentile(95)
+	responseP99 := a.responseHistogram.Percentile(99)
+	responseP999 := a.responseHistogram.Percentile(99.9)
+
+	if a.serviceDigest != nil {
+		p50 = time.Duration(a.serviceDigest.Quantile(0.50))
+		p90 = time.Duration(a.serviceDigest.Quantile(0.90))
+		p95 = time.Duration(a.serviceDigest.Quantile(0.95))
+		p99 = time.Duration(a.serviceDigest.Quantile(0.99))
+		p999 = time.Duration(a.serviceDigest.Quantile(0.999))
+
+		responseP50 = time.Duration(a.responseDigest.Quantile(0.50))
+		responseP90 = time.Duration(a.responseDigest.Quantile(0.90))
+		responseP95 = time.Duration(a.responseDigest.Quantile(0.95))
+		responseP99 = time.Duration(a.responseDigest.Quantile(0.99))
+		responseP999 = time.Duration(a.responseDigest.Quantile(0.999))
+	}
+
+	errorRate := 0.0
+	if scheduledTotal > 0 {
+		errorRate = float64(a.errors) / float64(scheduledTotal) * 100
+	}
+
+	minLatency := a.minLatency
+	if a.completed == 0 {
+		minLatency = 0
+	}
+
+	return LoadTestMetrics{
+		TotalRequests:             scheduledTotal,
+		AverageLatency:            avgLatency.String(),
+		RequestsPerSecond:         rps,
+		MinLatency:                minLatency.String(),
+		MaxLatency:                a.maxLatency.String(),
+		ErrorRate:                 errorRate,
+		ResStatusMetrics:          a.statusSnapshotLocked(),
+		P50:                       p50.String(),
+		P90:                       p90.String(),
+		P95:                       p95.String(),
+		P99:                       p99.String(),
+		P999:                      p999.String(),
+		ResponseP50:               responseP50.String(),
+		ResponseP90:               responseP90.String(),
+		ResponseP95:               responseP95.String(),
+		ResponseP99:               responseP99.String(),
+		ResponseP999:              responseP999.String(),
+		Dropped:                   a.dropped,
+		CoordinatedOmissionEvents: a.coordinatedOmissionEvents,
+		Histogram:                 a.serviceHistogram.Export(),
+		ResponseHistogram:         a.responseHistogram.Export(),
+	}
+}
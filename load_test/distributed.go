@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// RedisClient is the shared Redis connection used for agent coordination.
+// It mirrors the connection pattern the sibling book service uses, reading
+// the same RedisHost/RedisPort/RedisPassword environment variables.
+var RedisClient *redis.Client
+var redisCtx = context.Background()
+
+var redisConnectOnce sync.Once
+var redisConnectErr error
+
+// ensureRedisConnected connects to Redis the first time it's called and
+// reuses that result on every later call, so a single-node CSV-backed run
+// never has to reach Redis: only /loadtest/distributed and the
+// RESULT_STORE_BACKEND=redis result store actually need it.
+func ensureRedisConnected() error {
+	redisConnectOnce.Do(func() {
+		redisConnectErr = ConnectToRedis()
+	})
+	return redisConnectErr
+}
+
+const (
+	jobsChannel       = "loadtest:jobs"
+	agentsSet         = "loadtest:agents"
+	agentHeartbeatTTL = 10 * time.Second
+)
+
+// ConnectToRedis connects to Redis using environment-provided credentials.
+func ConnectToRedis() error {
+	redisHost := os.Getenv("RedisHost")
+	redisPort := os.Getenv("RedisPort")
+	redisPassword := os.Getenv("RedisPassword")
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     fmt.Sprintf("%s:%s", redisHost, redisPort),
+		Password: redisPassword,
+		DB:       0,
+	})
+
+	if _, err := client.Ping(redisCtx).Result(); err != nil {
+		return fmt.Errorf("failed to connect to redis: %w", err)
+	}
+
+	RedisClient = client
+	return nil
+}
+
+// JobDescriptor is the work assignment the coordinator publishes to agents.
+type JobDescriptor struct {
+	RunID       string    `json:"run_id"`
+	URL         string    `json:"url"`
+	Profile     string    `json:"profile"`
+	RPS         int       `json:"rps"` // this agent's share of the total rps
+	Duration    int       `json:"duration"`
+	RampFrom    int       `json:"ramp_from"`
+	MaxInflight int       `json:"max_inflight"`
+	Estimator   string    `json:"estimator"`
+	Protocol    string    `json:"protocol"`
+	GRPCMethod  string    `json:"grpc_method"`
+	GRPCStream  bool      `json:"grpc_stream"`
+	StartAt     time.Time `json:"start_at"`
+}
+
+// AgentResult is what an agent pushes back to the coordinator once its share
+// of the job has finished.
+type AgentResult struct {
+	AgentID string          `json:"agent_id"`
+	Metrics LoadTestMetrics `json:"metrics"`
+}
+
+func resultsListKey(runID string) string {
+	return "loadtest:results:" + runID
+}
+
+// registerAgent adds agentID to the live-agent set with a heartbeat TTL so
+// the coordinator can shard rps across only the agents that are actually up,
+// and refreshes it in the background until ctx is cancelled.
+func registerAgent(ctx context.Context, agentID string) {
+	refresh := func() {
+		if err := RedisClient.Set(redisCtx, "loadtest:agent:"+agentID, time.Now().Unix(), agentHeartbeatTTL).Err(); err != nil {
+			fmt.Println("Error refreshing agent heartbeat:", err)
+		}
+		RedisClient.SAdd(redisCtx, agentsSet, agentID)
+	}
+	refresh()
+
+	ticker := time.NewTicker(agentHeartbeatTTL / 2)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				RedisClient.SRem(redisCtx, agentsSet, agentID)
+				return
+			case <-ticker.C:
+				refresh()
+			}
+		}
+	}()
+}
+
+// liveAgents returns the agent IDs whose heartbeat key has not expired,
+// pruning any that have gone stale from agentsSet.
+func liveAgents() []string {
+	members, err := RedisClient.SMembers(redisCtx, agentsSet).Result()
+	if err != nil {
+		fmt.Println("Error listing agents:", err)
+		return nil
+	}
+
+	var live []string
+	for _, id := range members {
+		exists, err := RedisClient.Exists(redisCtx, "loadtest:agent:"+id).Result()
+		if err != nil {
+			continue
+		}
+		if exists == 0 {
+			RedisClient.SRem(redisCtx, agentsSet, id)
+			continue
+		}
+		live = append(live, id)
+	}
+	return live
+}
+
+// RunAgent subscribes to the jobs channel and executes whichever job it
+// receives using the shared runLoadTest core, pushing the resulting metrics
+// back into the run's results list for the coordinator to collect.
+func RunAgent(agentID string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registerAgent(ctx, agentID)
+
+	sub := RedisClient.Subscribe(redisCtx, jobsChannel)
+	defer sub.Close()
+
+	log.Printf("Agent %s listening for jobs on %s", agentID, jobsChannel)
+	for msg := range sub.Channel() {
+		var job JobDescriptor
+		if err := json.Unmarshal([]byte(msg.Payload), &job); err != nil {
+			fmt.Println("Agent received malformed job:", err)
+			continue
+		}
+
+		profile, err := newLoadProfile(job.Profile, job.RPS, job.RampFrom)
+		if err != nil {
+			fmt.Println("Agent could not build profile:", err)
+			continue
+		}
+
+		if wait := time.Until(job.StartAt); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		protocolOpts := ProtocolOptions{GRPCMethod: job.GRPCMethod, GRPCStream: job.GRPCStream}
+		metrics := runLoadTest(context.Background(), job.URL, job.RPS, job.Duration, job.MaxInflight, profile, job.Estimator, job.Protocol, protocolOpts)
+
+		payload, err := json.Marshal(AgentResult{AgentID: agentID, Metrics: metrics})
+		if err != nil {
+			fmt.Println("Agent could not marshal result:", err)
+			continue
+		}
+		if err := RedisClient.RPush(redisCtx, resultsListKey(job.RunID), payload).Err(); err != nil {
+			fmt.Println("Agent could not push result:", err)
+		}
+	}
+}
+
+// DistributedLoadTestHandler shards a single load test across every agent
+// currently registered in Redis (responding 503 if none are up), then
+// merges the per-agent metrics into one aggregated response.
+func DistributedLoadTestHandler(w http.ResponseWriter, r *http.Request) {
+	if err := ensureRedisConnected(); err != nil {
+		http.Error(w, fmt.Sprintf("redis unavailable: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	url := r.URL.Query().Get("url")
+	rps, err := strconv.Atoi(r.URL.Query().Get("rps"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	duration, err := strconv.Atoi(r.URL.Query().Get("duration"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rampFrom, _ := strconv.Atoi(r.URL.Query().Get("ramp_from"))
+	maxInflight, _ := strconv.Atoi(r.URL.Query().Get("max_inflight"))
+	profileName := r.URL.Query().Get("profile")
+	estimator := r.URL.Query().Get("estimator")
+	protocolName := r.URL.Query().Get("protocol")
+	grpcMethod := r.URL.Query().Get("grpc_method")
+	grpcStream := r.URL.Query().Get("grpc_stream") == "true"
+
+	agents := liveAgents()
+	if len(agents) == 0 {
+		http.Error(w, "no agents registered; use /loadtest for a single-node run", http.StatusServiceUnavailable)
+		return
+	}
+
+	runID := uuid.NewString()
+	share := rps / len(agents)
+	if share <= 0 {
+		share = 1
+	}
+	startAt := time.Now().Add(2 * time.Second)
+
+	job := JobDescriptor{
+		RunID:       runID,
+		URL:         url,
+		Profile:     profileName,
+		RPS:         share,
+		Duration:    duration,
+		RampFrom:    rampFrom,
+		MaxInflight: maxInflight,
+		Estimator:   estimator,
+		Protocol:    protocolName,
+		GRPCMethod:  grpcMethod,
+		GRPCStream:  grpcStream,
+		StartAt:     startAt,
+	}
+	payload, err := json.Marshal(job)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := RedisClient.Publish(redisCtx, jobsChannel, payload).Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	deadline := startAt.Add(time.Duration(duration) * time.Second).Add(5 * time.Second)
+	listKey := resultsListKey(runID)
+	agentResults := make([]AgentResult, 0, len(agents))
+
+	for time.Now().Before(deadline) && len(agentResults) < len(agents) {
+		payload, err := RedisClient.LPop(redisCtx, listKey).Result()
+		if err == redis.Nil {
+			time.Sleep(250 * time.Millisecond)
+			continue
+		}
+		if err != nil {
+			fmt.Println("Error draining results:", err)
+			break
+		}
+		var result AgentResult
+		if err := json.Unmarshal([]byte(payload), &result); err != nil {
+			fmt.Println("Coordinator received malformed result:", err)
+			continue
+		}
+		agentResults = append(agentResults, result)
+	}
+	RedisClient.Del(redisCtx, listKey)
+
+	merged := mergeAgentMetrics(agentResults)
+	perAgent := make(map[string]LoadTestMetrics, len(agentResults))
+	for _, result := range agentResults {
+		perAgent[result.AgentID] = result.Metrics
+	}
+
+	response := struct {
+		RunID    string                     `json:"run_id"`
+		Metrics  LoadTestMetrics            `json:"metrics"`
+		PerAgent map[string]LoadTestMetrics `json:"per_agent"`
+	}{RunID: runID, Metrics: merged, PerAgent: perAgent}
+
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
+
+// mergeAgentMetrics combines each agent's independently computed metrics into
+// one aggregate. Percentiles are recomputed from a merged histogram rather
+// than picked from a single "representative" agent: each agent's exported
+// Histogram/ResponseHistogram buckets are folded back into a fresh
+// HDRHistogram via AddBucket, and those per-agent histograms are combined
+// with the existing Merge so the reported percentiles reflect every agent's
+// traffic, not just whichever shard happened to see the most requests.
+func mergeAgentMetrics(results []AgentResult) LoadTestMetrics {
+	var merged LoadTestMetrics
+	merged.ResStatusMetrics = make(map[int]*ResponseStatusCodeMetrics)
+	if len(results) == 0 {
+		return merged
+	}
+
+	serviceHistogram := newLatencyHistogram()
+	responseHistogram := newLatencyHistogram()
+
+	var totalErrors float64
+	for _, result := range results {
+		m := result.Metrics
+		merged.TotalRequests += m.TotalRequests
+		merged.RequestsPerSecond += m.RequestsPerSecond
+		merged.Dropped += m.Dropped
+		merged.CoordinatedOmissionEvents += m.CoordinatedOmissionEvents
+		// Recover each agent's error count from its percentage rather than
+		// averaging the percentages themselves, so an agent that handled far
+		// more (or fewer) requests doesn't get the same say as one that
+		// barely ran - the same errors/total arithmetic Snapshot uses.
+		totalErrors += m.ErrorRate / 100 * float64(m.TotalRequests)
+
+		for status, statusMetrics := range m.ResStatusMetrics {
+			if _, ok := merged.ResStatusMetrics[status]; !ok {
+				merged.ResStatusMetrics[status] = &ResponseStatusCodeMetrics{}
+			}
+			merged.ResStatusMetrics[status].Count += statusMetrics.Count
+		}
+
+		agentService := newLatencyHistogram()
+		for _, bucket := range m.Histogram {
+			if err := agentService.AddBucket(bucket); err != nil {
+				fmt.Println("Error merging agent service histogram:", err)
+			}
+		}
+		serviceHistogram.Merge(agentService)
+
+		agentResponse := newLatencyHistogram()
+		for _, bucket := range m.ResponseHistogram {
+			if err := agentResponse.AddBucket(bucket); err != nil {
+				fmt.Println("Error merging agent response histogram:", err)
+			}
+		}
+		responseHistogram.Merge(agentResponse)
+	}
+	if merged.TotalRequests > 0 {
+		merged.ErrorRate = totalErrors / float64(merged.TotalRequests) * 100
+	}
+
+	merged.P50 = serviceHistogram.Percentile(50).String()
+	merged.P90 = serviceHistogram.Percentile(90).String()
+	merged.P95 = serviceHistogram.Percentile(95).String()
+	merged.P99 = serviceHistogram.Percentile(99).String()
+	merged.P999 = serviceHistogram.Percentile(99.9).String()
+
+	merged.ResponseP50 = responseHistogram.Percentile(50).String()
+	merged.ResponseP90 = responseHistogram.Percentile(90).String()
+	merged.ResponseP95 = responseHistogram.Percentile(95).String()
+	merged.ResponseP99 = responseHistogram.Percentile(99).String()
+	merged.ResponseP999 = responseHistogram.Percentile(99.9).String()
+
+	merged.Histogram = serviceHistogram.Export()
+	merged.ResponseHistogram = responseHistogram.Export()
+
+	return merged
+}
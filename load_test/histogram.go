@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// HDRHistogram is a fixed, log-linear bucketed histogram of latencies. It
+// trades the full O(N) latency slice the naive percentile calculation used
+// for a bounded number of buckets, so a long-running test no longer has to
+// keep every sample in memory to report percentiles. Bucket counts are plain
+// int64s updated with atomic.AddInt64, so Record is safe to call
+// concurrently from multiple workers without a mutex.
+type HDRHistogram struct {
+	lowestDiscernible time.Duration
+	highestTrackable  time.Duration
+	sigDigits         int
+	bucketWidth       float64 // log-width of each bucket, in log-space
+	buckets           []int64
+	overflow          int64 // count of values above highestTrackable
+}
+
+// NewHDRHistogram creates a histogram covering [low, high] with the given
+// number of significant decimal digits of resolution (typically 2-3).
+func NewHDRHistogram(low, high time.Duration, sigDigits int) *HDRHistogram {
+	if low <= 0 {
+		low = time.Microsecond
+	}
+	if high <= low {
+		high = low * 2
+	}
+	// sigDigits significant decimal digits means two values in the same
+	// decade can't be told apart once they're within 10^-sigDigits of each
+	// other relatively, so each decade needs 10^sigDigits buckets to bound
+	// that relative error - sigDigits*10 buckets per decade (the previous
+	// formula here) is 5-33x too coarse for 2-3 digits and was measurably off in
+	// percentile comparisons against raw samples.
+	bucketsPerDecade := int(math.Pow(10, float64(sigDigits)))
+	decades := math.Log10(float64(high) / float64(low))
+	numBuckets := int(decades*float64(bucketsPerDecade)) + 1
+
+	return &HDRHistogram{
+		lowestDiscernible: low,
+		highestTrackable:  high,
+		sigDigits:         sigDigits,
+		bucketWidth:       decades / float64(numBuckets),
+		buckets:           make([]int64, numBuckets),
+	}
+}
+
+func (h *HDRHistogram) bucketFor(d time.Duration) int {
+	if d <= h.lowestDiscernible {
+		return 0
+	}
+	logOffset := math.Log10(float64(d) / float64(h.lowestDiscernible))
+	idx := int(logOffset / h.bucketWidth)
+	if idx >= len(h.buckets) {
+		return len(h.buckets) - 1
+	}
+	return idx
+}
+
+// Record adds a single latency sample to the histogram.
+func (h *HDRHistogram) Record(d time.Duration) {
+	if d > h.highestTrackable {
+		atomic.AddInt64(&h.overflow, 1)
+		return
+	}
+	atomic.AddInt64(&h.buckets[h.bucketFor(d)], 1)
+}
+
+// Merge folds another histogram's counts into this one. Both histograms must
+// have been created with the same bounds and significant digits.
+func (h *HDRHistogram) Merge(other *HDRHistogram) {
+	if other == nil {
+		return
+	}
+	for i, count := range other.buckets {
+		if count != 0 {
+			atomic.AddInt64(&h.buckets[i], count)
+		}
+	}
+	atomic.AddInt64(&h.overflow, atomic.LoadInt64(&other.overflow))
+}
+
+// AddBucket folds one exported HistogramBucket (as produced by Export) back
+// into the histogram, landing it in whichever bucket its upper bound falls
+// into. It's lossy relative to the original samples - every value in that
+// bucket is assumed to sit at its upper edge - but that's the same
+// resolution Percentile already reports at, so merging exported buckets
+// across agents doesn't lose any precision Percentile would otherwise have
+// given.
+func (h *HDRHistogram) AddBucket(bucket HistogramBucket) error {
+	if bucket.UpperBound == "+Inf" {
+		atomic.AddInt64(&h.overflow, bucket.Count)
+		return nil
+	}
+	upperBound, err := time.ParseDuration(bucket.UpperBound)
+	if err != nil {
+		return fmt.Errorf("parsing histogram bucket upper bound %q: %w", bucket.UpperBound, err)
+	}
+	idx := h.bucketFor(upperBound - time.Nanosecond)
+	atomic.AddInt64(&h.buckets[idx], bucket.Count)
+	return nil
+}
+
+// total returns the number of samples recorded so far.
+func (h *HDRHistogram) total() int64 {
+	var total int64
+	for _, count := range h.buckets {
+		total += count
+	}
+	return total + atomic.LoadInt64(&h.overflow)
+}
+
+// bucketUpperBound returns the upper latency edge represented by bucket i.
+func (h *HDRHistogram) bucketUpperBound(i int) time.Duration {
+	logOffset := float64(i+1) * h.bucketWidth
+	return time.Duration(float64(h.lowestDiscernible) * math.Pow(10, logOffset))
+}
+
+// Percentile returns the estimated duration at the given percentile (0-100),
+// using the upper bound of whichever bucket contains that rank.
+func (h *HDRHistogram) Percentile(percentile float64) time.Duration {
+	total := h.total()
+	if total == 0 {
+		return 0
+	}
+	target := int64(math.Ceil(percentile / 100 * float64(total)))
+
+	var cumulative int64
+	for i, count := range h.buckets {
+		cumulative += count
+		if cumulative >= target {
+			return h.bucketUpperBound(i)
+		}
+	}
+	return h.highestTrackable
+}
+
+// HistogramBucket is the JSON/CSV-exportable form of a single bucket.
+type HistogramBucket struct {
+	UpperBound string `json:"upper_bound"`
+	Count      int64  `json:"count"`
+}
+
+// Export returns every non-empty bucket, suitable for serializing the full
+// distribution rather than just a handful of percentiles.
+func (h *HDRHistogram) Export() []HistogramBucket {
+	var buckets []HistogramBucket
+	for i, count := range h.buckets {
+		if count == 0 {
+			continue
+		}
+		buckets = append(buckets, HistogramBucket{
+			UpperBound: h.bucketUpperBound(i).String(),
+			Count:      count,
+		})
+	}
+	if overflow := atomic.LoadInt64(&h.overflow); overflow > 0 {
+		buckets = append(buckets, HistogramBucket{UpperBound: "+Inf", Count: overflow})
+	}
+	return buckets
+}
+
+// histogramLow/histogramHigh cover 1us to 60s, the practical range for HTTP
+// request latencies, with 3 significant digits of resolution.
+const (
+	histogramLow       = time.Microsecond
+	histogramHigh      = 60 * time.Second
+	histogramSigDigits = 3
+)
+
+// newLatencyHistogram builds a histogram using the default bounds shared by
+// every load test run.
+func newLatencyHistogram() *HDRHistogram {
+	return NewHDRHistogram(histogramLow, histogramHigh, histogramSigDigits)
+}
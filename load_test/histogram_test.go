@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"testing"
+	"time"
+)
+
+// truePercentile computes the exact percentile of a raw sample slice, for
+// comparison against the bucketed HDRHistogram estimate.
+func truePercentile(samples []time.Duration, percentile float64) time.Duration {
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	idx := int(math.Ceil(percentile/100*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+// TestHDRHistogramPercentileAccuracy checks that the bucketed histogram
+// stays within its claimed significant-digit precision against a known,
+// log-uniformly distributed sample set - the bug fixed in 1fe7cc8 let this
+// drift to 3-4% error with far too few buckets per decade.
+func TestHDRHistogramPercentileAccuracy(t *testing.T) {
+	h := newLatencyHistogram()
+
+	var samples []time.Duration
+	rng := uint64(12345)
+	for i := 0; i < 100000; i++ {
+		// xorshift64 for a deterministic, dependency-free PRNG.
+		rng ^= rng << 13
+		rng ^= rng >> 7
+		rng ^= rng << 17
+		// Spread samples log-uniformly across 1ms-5s, a realistic latency range.
+		frac := float64(rng%1_000_000) / 1_000_000
+		d := time.Duration(float64(time.Millisecond) * math.Pow(5000, frac))
+		samples = append(samples, d)
+		h.Record(d)
+	}
+
+	for _, p := range []float64{50, 90, 99, 99.9} {
+		got := h.Percentile(p)
+		want := truePercentile(samples, p)
+		if want == 0 {
+			continue
+		}
+		relErr := math.Abs(float64(got-want)) / float64(want)
+		if relErr > 0.01 {
+			t.Errorf("p%v: got %v, want ~%v (relative error %.4f, expected <= 1%% for %d significant digits)",
+				p, got, want, relErr, histogramSigDigits)
+		}
+	}
+}
+
+// TestHDRHistogramMergeAndAddBucket checks that folding one histogram's
+// exported buckets into another (the cross-agent merge path used by
+// mergeAgentMetrics) reproduces the same total count and a percentile close
+// to merging the raw samples directly.
+func TestHDRHistogramMergeAndAddBucket(t *testing.T) {
+	a := newLatencyHistogram()
+	b := newLatencyHistogram()
+
+	for i := 0; i < 1000; i++ {
+		a.Record(time.Duration(i+1) * time.Millisecond)
+	}
+	for i := 0; i < 1000; i++ {
+		b.Record(time.Duration(i+1) * 5 * time.Millisecond)
+	}
+
+	reconstructed := newLatencyHistogram()
+	for _, bucket := range a.Export() {
+		if err := reconstructed.AddBucket(bucket); err != nil {
+			t.Fatalf("AddBucket: %v", err)
+		}
+	}
+	reconstructed.Merge(b)
+
+	if got, want := reconstructed.total(), int64(2000); got != want {
+		t.Fatalf("total after merge = %d, want %d", got, want)
+	}
+
+	merged := newLatencyHistogram()
+	merged.Merge(a)
+	merged.Merge(b)
+	gotP90 := reconstructed.Percentile(90)
+	wantP90 := merged.Percentile(90)
+	if gotP90 != wantP90 {
+		t.Errorf("p90 after AddBucket-based merge = %v, want %v (direct merge)", gotP90, wantP90)
+	}
+}
@@ -2,140 +2,78 @@ package main
 
 import (
 	"context"
-	"encoding/csv"
-	"encoding/json"
 	"fmt"
 	"log"
-	"math"
 	"net/http"
 	"os"
 	"os/signal"
-	"sort"
 	"strconv"
 	"sync"
 	"syscall"
 	"time"
 )
 
-// Define the error counter as an int64 global variable
-var (
-	errCounter  int64
-	errCounterM sync.Mutex // Mutex for error counter
-)
-
-// Retrieve the current value of the error counter
-func getErrorCounter() int64 {
-	errCounterM.Lock()
-	defer errCounterM.Unlock()
-	return errCounter
-}
-
-// Increment the error counter
-func incrementErrorCounter() {
-	errCounterM.Lock()
-	defer errCounterM.Unlock()
-	errCounter++
-}
-
 // Worker is a struct that represents a concurrent worker
 type Worker struct {
-	id     int
-	url    string
-	client *http.Client
-	mutex  sync.Mutex // Mutex for synchronizing access to results channel
+	id       int
+	protocol Protocol
 }
 
 // Result is a struct that holds the result of a request
 type Result struct {
 	workerID int           // worker id
 	status   int           // status code
-	latency  time.Duration // latency
+	bytes    int64         // response bytes read
+	latency  time.Duration // service latency: dispatch -> completion
+	response time.Duration // response latency: scheduled -> completion
+	overdue  bool          // true if the request was dispatched after its scheduled time (coordinated omission)
 	err      error         // error if any
 }
 
-// NewWorker creates a new worker with the given parameters
-// NewWorker creates a new worker with the given parameters
-func NewWorker(id int, url string, client *http.Client) *Worker {
+// NewWorker creates a new worker that drives the given protocol
+func NewWorker(id int, protocol Protocol) *Worker {
 	return &Worker{
-		id:     id,
-		url:    url,
-		client: client,
-		mutex:  sync.Mutex{}, // Initialize the mutex
+		id:       id,
+		protocol: protocol,
 	}
 }
 
-// Run runs the worker and sends the results to the given channel
-func (w *Worker) Run(results chan<- Result, duration time.Duration) {
+// coordinatedOmissionTolerance is how far late a dispatch can be before it is
+// counted as a coordinated-omission event rather than ordinary jitter.
+const coordinatedOmissionTolerance = 10 * time.Millisecond
+
+// Run dispatches the arrival's scheduled request and sends the result to the
+// given channel. It records both the service latency (how long the request
+// itself took) and the response latency (how long it took from when the
+// request was *supposed* to fire), so a backed-up generator doesn't hide tail
+// latency behind an artificially fast worker pool. A panic is reported back
+// as an errored Result rather than a separate counter, since the
+// MetricsAggregator reading results is already the single place errors are
+// tallied.
+func (w *Worker) Run(ctx context.Context, results chan<- Result, arrival Arrival) {
 	defer func() {
-		// handle panic gracefully
 		if r := recover(); r != nil {
-			incrementErrorCounter()
 			fmt.Println("Worker", w.id, "panicked:", r)
+			results <- Result{workerID: w.id, err: fmt.Errorf("panic: %v", r)}
 		}
 	}()
 
-	// Make a GET request and measure the latency
+	dispatched := time.Now()
+	overdue := dispatched.Sub(arrival.Scheduled) > coordinatedOmissionTolerance
+
+	// Drive the request through whichever protocol this worker was built
+	// with and measure the latency.
 	start := time.Now()
-	resp, err := w.client.Get(w.url)
-	latency := time.Since(start)
+	status, bytes, err := w.protocol.Do(ctx)
+	completed := time.Now()
+	latency := completed.Sub(start)
+	response := completed.Sub(arrival.Scheduled)
 
-	// Send the result to the channel
-	result := Result{w.id, 0, latency, err}
 	if err != nil {
 		fmt.Println(err)
-		incrementErrorCounter()
-	} else {
-		// Close the response body immediately after use
-		defer resp.Body.Close()
-		result.status = resp.StatusCode
 	}
 
-	// Protect access to the results channel with a mutex
-	w.mutex.Lock()
-	defer w.mutex.Unlock()
-
-	// Send the result to the channel
-	results <- result
-}
-
-// Write load test metrics to a CSV file
-func writeMetricsToCSV(url string, metrics LoadTestMetrics) error {
-	// Open the CSV file for writing in append mode
-	file, err := os.OpenFile("metrics.csv", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	// Create a CSV writer
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
-
-	// Convert load test metrics to a slice of strings
-	var record []string
-	record = append(record, url)
-	record = append(record, strconv.Itoa(metrics.TotalRequests))
-	record = append(record, metrics.AverageLatency)
-	record = append(record, strconv.Itoa(metrics.RequestsPerSecond))
-	record = append(record, metrics.MinLatency)
-	record = append(record, metrics.MaxLatency)
-	record = append(record, fmt.Sprintf("%.2f", metrics.ErrorRate))
-
-	// Convert ResponseStatusCodeMetrics to a slice of strings
-	for statusCode, statusMetrics := range metrics.ResStatusMetrics {
-		record = append(record, strconv.Itoa(statusCode))
-		record = append(record, strconv.Itoa(statusMetrics.Count))
-		record = append(record, statusMetrics.MinLatency)
-		record = append(record, statusMetrics.MaxLatency)
-		record = append(record, statusMetrics.AvgLatency)
-	}
-
-	// Write metrics to the CSV file
-	if err := writer.Write(record); err != nil {
-		return err
-	}
-
-	return nil
+	results <- Result{w.id, status, bytes, latency, response, overdue, err}
 }
 
 // Define a struct to store the status code metrics
@@ -161,19 +99,42 @@ type LoadTestMetrics struct {
 	MaxLatency        string                             `json:"max_latency"`
 	ErrorRate         float64                            `json:"error_rate"`
 	ResStatusMetrics  map[int]*ResponseStatusCodeMetrics `json:"status_metrics"` // map of status code metrics
-	P50               string                             `json:"p50"`
-	P90               string                             `json:"p90"`
-	P95               string                             `json:"p95"`
-	P99               string                             `json:"p99"`
+	// Service latency percentiles: dispatch -> completion.
+	P50  string `json:"p50"`
+	P90  string `json:"p90"`
+	P95  string `json:"p95"`
+	P99  string `json:"p99"`
+	P999 string `json:"p999"`
+	// Response latency percentiles: scheduled -> completion. These include
+	// coordinated-omission delay and are the numbers that reflect what a
+	// real client would have experienced.
+	ResponseP50  string `json:"response_p50"`
+	ResponseP90  string `json:"response_p90"`
+	ResponseP95  string `json:"response_p95"`
+	ResponseP99  string `json:"response_p99"`
+	ResponseP999 string `json:"response_p999"`
+	// Dropped is the number of scheduled requests that were skipped because
+	// max_inflight was already saturated.
+	Dropped int `json:"dropped"`
+	// CoordinatedOmissionEvents counts requests dispatched more than
+	// coordinatedOmissionTolerance after their scheduled time.
+	CoordinatedOmissionEvents int `json:"coordinated_omission_events"`
+	// Histogram and ResponseHistogram export every non-empty bucket of the
+	// underlying HDR histograms, for callers that want the full distribution
+	// rather than a handful of percentiles.
+	Histogram         []HistogramBucket `json:"histogram,omitempty"`
+	ResponseHistogram []HistogramBucket `json:"response_histogram,omitempty"`
+	// Protocol is which driver ran the test ("http", "http2", "grpc",
+	// "websocket", "tcp"), along with the bytes and connection reuse it saw.
+	Protocol          string `json:"protocol"`
+	BytesIn           int64  `json:"bytes_in"`
+	BytesOut          int64  `json:"bytes_out"`
+	ConnectionsReused int64  `json:"connections_reused"`
+	ConnectionsNew    int64  `json:"connections_new"`
 }
 
 // LoadTestHandler handles the load testing
 func LoadTestHandler(w http.ResponseWriter, r *http.Request) {
-	// Reset error counter before starting a new test
-	errCounterM.Lock()
-	errCounter = 0
-	errCounterM.Unlock()
-
 	// Parse query parameters
 	url := r.URL.Query().Get("url")
 	rps, err := strconv.Atoi(r.URL.Query().Get("rps"))
@@ -186,192 +147,202 @@ func LoadTestHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	// Calculate total number of requests needed
-	totalRequests := rps * duration
-
-	// Create a wait group for workers
-	wg := &sync.WaitGroup{}
-
-	// Create a channel for results
-	results := make(chan Result, totalRequests)
-
-	// Calculate the request timeout
-	timeout := time.Second * time.Duration(duration)
-
-	// Create an HTTP client with the calculated timeout
-	client := &http.Client{
-		Timeout: timeout,
-	}
-
-	// Create a map to store status code metrics
-	statusMetrics := make(map[int]*StatusCodeMetrics)
-	statusMetricsM := sync.Mutex{} // Mutex for statusMetrics
-
-	// Slice to store latencies of all requests
-	var latencies []time.Duration
-
-	for i := 0; i < duration; i++ {
-		// Create and run workers
-		for i := 0; i < rps; i++ {
-			worker := NewWorker(i, url, client)
-			wg.Add(1)
-			go func(worker *Worker) {
-				worker.Run(results, time.Duration(duration))
-				wg.Done()
-			}(worker)
+	rampFrom, _ := strconv.Atoi(r.URL.Query().Get("ramp_from"))
+	maxInflight, err := strconv.Atoi(r.URL.Query().Get("max_inflight"))
+	if err != nil || maxInflight <= 0 {
+		maxInflight = rps
+		if maxInflight <= 0 {
+			maxInflight = 1
 		}
-		time.Sleep(time.Second)
 	}
-	// Wait for all workers to finish
-	wg.Wait()
-	close(results)
-
-	// Collect and print metrics
-	var minLatency, maxLatency time.Duration
-	// Declare a variable to store the sum of latencies
-	var sumLatency time.Duration
-	minLatency = time.Duration(math.MaxInt64)
-	totalErrors := getErrorCounter()
-
-	// Iterate over the results
-	for result := range results {
-		if result.err != nil {
-			incrementErrorCounter()
-			continue
-		}
-		// Add the latency to the sum
-		sumLatency += result.latency
-
-		// Add latency to slice
-		latencies = append(latencies, result.latency)
-
-		if result.latency < minLatency {
-			minLatency = result.latency
-		}
-		if result.latency > maxLatency {
-			maxLatency = result.latency
-		}
 
-		// Update status code metrics
-		statusMetricsM.Lock()
-		if _, ok := statusMetrics[result.status]; !ok {
-			statusMetrics[result.status] = &StatusCodeMetrics{
-				Count:      0,
-				MinLatency: time.Duration(math.MaxInt64),
-				MaxLatency: 0,
-				SumLatency: 0,
-			}
-		}
-		statusMetrics[result.status].Count++
-		statusMetrics[result.status].SumLatency += result.latency
-		if result.latency < statusMetrics[result.status].MinLatency {
-			statusMetrics[result.status].MinLatency = result.latency
-		}
-		if result.latency > statusMetrics[result.status].MaxLatency {
-			statusMetrics[result.status].MaxLatency = result.latency
-		}
-		statusMetricsM.Unlock()
+	profile, err := newLoadProfile(r.URL.Query().Get("profile"), rps, rampFrom)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// Calculate average latency
-	avgLatency := time.Duration(0)
-	if totalRequests > 0 {
-		avgLatency = sumLatency / time.Duration(totalRequests)
+	estimator := r.URL.Query().Get("estimator")
+	protocolName := r.URL.Query().Get("protocol")
+	protocolOpts := ProtocolOptions{
+		GRPCMethod: r.URL.Query().Get("grpc_method"),
+		GRPCStream: r.URL.Query().Get("grpc_stream") == "true",
 	}
 
-	// Calculate percentiles
-	p50 := calculatePercentile(latencies, 50)
-	p90 := calculatePercentile(latencies, 90)
-	p95 := calculatePercentile(latencies, 95)
-	p99 := calculatePercentile(latencies, 99)
-
-	// Calculate error rate
-	errorRate := float64(totalErrors) / float64(totalRequests) * 100
-
-	resStatusMetrics := make(map[int]*ResponseStatusCodeMetrics)
-	for status, metrics := range statusMetrics {
-		resStatusMetrics[status] = &ResponseStatusCodeMetrics{
-			Count:      metrics.Count,
-			MinLatency: metrics.MinLatency.String(),
-			MaxLatency: metrics.MaxLatency.String(),
-			AvgLatency: (metrics.SumLatency / time.Duration(metrics.Count)).String(),
-		}
+	runID := newRunID()
+	ctx, cancel := context.WithCancel(r.Context())
+	registerRunCancel(runID, cancel)
+	defer unregisterRunCancel(runID)
+
+	startedAt := time.Now()
+	loadTestMetrics := runLoadTest(ctx, url, rps, duration, maxInflight, profile, estimator, protocolName, protocolOpts)
+
+	run := Run{
+		RunID:     runID,
+		StartedAt: startedAt,
+		URL:       url,
+		Params: map[string]string{
+			"rps":      strconv.Itoa(rps),
+			"duration": strconv.Itoa(duration),
+			"profile":  r.URL.Query().Get("profile"),
+			"protocol": protocolName,
+		},
+		Metrics: loadTestMetrics,
 	}
-	// Create the LoadTestMetrics struct
-	loadTestMetrics := LoadTestMetrics{
-		TotalRequests:     totalRequests,
-		AverageLatency:    avgLatency.String(),
-		RequestsPerSecond: rps,
-		MinLatency:        minLatency.String(),
-		MaxLatency:        maxLatency.String(),
-		ErrorRate:         errorRate,
-		ResStatusMetrics:  resStatusMetrics,
-		P50:               p50.String(),
-		P90:               p90.String(),
-		P95:               p95.String(),
-		P99:               p99.String(),
+	if err := resultStore.Save(run); err != nil {
+		fmt.Println("Error saving run:", err)
 	}
-	// Write load test metrics to CSV file
-	if err := writeMetricsToCSV(url, loadTestMetrics); err != nil {
-		fmt.Println("Error writing metrics to CSV:", err)
+
+	// Return the run, including its ID, as JSON
+	writeJSON(w, run)
+}
+
+// startLoadTest builds the protocol and begins scheduling and dispatching
+// arrivals in the background, returning the MetricsAggregator collecting
+// results, a channel that closes once every dispatched worker has
+// finished, and the Protocol instance (for its final connection stats).
+// Cancelling ctx stops the dispatch loop from picking up further arrivals
+// and is also passed down to in-flight requests, so /loadtest/cancel can
+// cut a run short. Both runLoadTest and /loadtest/stream build on this;
+// the only difference is whether they wait for done immediately or poll
+// the aggregator's Progress/Snapshot while it runs.
+func startLoadTest(ctx context.Context, url string, rps, duration, maxInflight int, profile LoadProfile, estimator, protocolName string, protocolOpts ProtocolOptions) (aggregator *MetricsAggregator, done <-chan struct{}, protocol Protocol) {
+	// bufferHint sizes the arrivals/results channels; it only needs to be in
+	// the right ballpark, since rps*duration is the *final* rate for
+	// ramp/step profiles rather than what they actually schedule. The real
+	// request count is counted as arrivals land, via aggregator.scheduled.
+	bufferHint := rps * duration
+	if bufferHint <= 0 {
+		bufferHint = 1
 	}
+	timeout := time.Second * time.Duration(duration)
 
-	// Return load test metrics as JSON
-	w.Header().Set("Content-Type", "application/json")
-	// Marshal loadTestMetrics to JSON
-	responseJSON, err := json.Marshal(loadTestMetrics)
+	// Every worker shares one Protocol instance so connection pooling (HTTP
+	// keep-alives, the gRPC channel, the WebSocket's single connection)
+	// works the way it would for a real client.
+	if protocolName == "" {
+		protocolName = "http"
+	}
+	protocol, err := newProtocol(protocolName, url, timeout, protocolOpts)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		fmt.Println("Error building protocol:", err)
+		closedDone := make(chan struct{})
+		close(closedDone)
+		return NewMetricsAggregator(estimator), closedDone, nil
 	}
 
-	// Set Content-Type header
-	w.Header().Set("Content-Type", "application/json")
+	aggregator = NewMetricsAggregator(estimator)
+	results := make(chan Result, bufferHint)
+	go aggregator.Run(results)
 
-	// Write JSON response
-	w.WriteHeader(http.StatusOK)
-	w.Write(responseJSON)
+	// Arrivals is the work queue the profile schedules requests onto.
+	// Decoupling arrivals from dispatch means a slow target no longer
+	// throttles the generator's clock.
+	arrivals := make(chan Arrival, bufferHint)
+	go profile.Schedule(arrivals, time.Now(), time.Duration(duration)*time.Second)
+
+	// inflight bounds the number of concurrent in-progress requests. Arrivals
+	// that show up while the cap is saturated are counted as dropped rather
+	// than blocking the scheduler.
+	inflight := make(chan struct{}, maxInflight)
+	aggregator.inflightChan = inflight
+
+	doneCh := make(chan struct{})
+	done = doneCh
+
+	go func() {
+		wg := &sync.WaitGroup{}
+		workerID := 0
+
+	dispatchLoop:
+		for {
+			select {
+			case <-ctx.Done():
+				break dispatchLoop
+			case arrival, ok := <-arrivals:
+				if !ok {
+					break dispatchLoop
+				}
+				aggregator.RecordScheduled()
+
+				select {
+				case inflight <- struct{}{}:
+				default:
+					aggregator.RecordDropped()
+					continue dispatchLoop
+				}
+
+				workerID++
+				worker := NewWorker(workerID, protocol)
+				aggregator.RecordDispatched()
+				wg.Add(1)
+				go func(worker *Worker, arrival Arrival) {
+					defer wg.Done()
+					defer func() { <-inflight }()
+					worker.Run(ctx, results, arrival)
+				}(worker, arrival)
+			}
+		}
+		wg.Wait()
+		close(results)
+		close(doneCh)
+	}()
+
+	return aggregator, done, protocol
 }
 
-// calculatePercentile calculates the nth percentile of the given data
-func calculatePercentile(data []time.Duration, percentile int) time.Duration {
-	if len(data) == 0 {
-		return 0
-	}
-	// Sort the data in ascending order
-	sort.Slice(data, func(i, j int) bool {
-		return data[i] < data[j]
-	})
-	// Determine the index position for the percentile
-	index := float64(percentile) / 100 * float64(len(data)-1)
-	// Check if the index is an integer
-	if index == float64(int(index)) {
-		// If the index is an integer, return the value at the index
-		return data[int(index)]
+// runLoadTest drives rps against url for duration seconds using the given
+// profile to schedule arrivals, blocking until the run finishes (or ctx is
+// cancelled) and returning the aggregated metrics. This is the shared core
+// behind both the single-node /loadtest handler and the distributed agent,
+// which runs the same logic for its shard of the rps.
+func runLoadTest(ctx context.Context, url string, rps, duration, maxInflight int, profile LoadProfile, estimator, protocolName string, protocolOpts ProtocolOptions) LoadTestMetrics {
+	aggregator, done, protocol := startLoadTest(ctx, url, rps, duration, maxInflight, profile, estimator, protocolName, protocolOpts)
+	<-done
+
+	metrics := aggregator.Snapshot(rps)
+	metrics.Protocol = protocolName
+	if protocol != nil {
+		stats := protocol.Stats()
+		metrics.BytesIn = stats.bytesIn
+		metrics.BytesOut = stats.bytesOut
+		metrics.ConnectionsReused = stats.reused
+		metrics.ConnectionsNew = stats.new
 	}
-	// If the index is not an integer, interpolate between the two nearest values
-	lowerIndex := int(math.Floor(index))
-	upperIndex := int(math.Ceil(index))
-	lowerValue := data[lowerIndex]
-	upperValue := data[upperIndex]
-	// Interpolate between the two nearest values
-	// Convert the difference between index and lowerIndex to time.Duration for multiplication
-	indexOffset := time.Duration(index - float64(lowerIndex))
-	// Interpolate between the two nearest values
-	interpolatedValue := lowerValue + (upperValue-lowerValue)*indexOffset
-	return interpolatedValue
+	return metrics
 }
 
 func main() {
+	// Running with LOADTEST_AGENT_ID set turns this binary into a
+	// distributed agent instead of a coordinator: it registers itself in
+	// Redis and waits for jobs instead of serving HTTP. Only this path
+	// requires Redis up front - a coordinator serving single-node,
+	// CSV-backed runs shouldn't fail to start just because Redis is down.
+	if agentID := os.Getenv("LOADTEST_AGENT_ID"); agentID != "" {
+		if err := ConnectToRedis(); err != nil {
+			log.Fatal(err)
+		}
+		RunAgent(agentID)
+		return
+	}
+
+	resultStore = newResultStore()
+
 	http.HandleFunc("/loadtest", LoadTestHandler)
+	http.HandleFunc("/loadtest/distributed", DistributedLoadTestHandler)
+	http.HandleFunc("/loadtest/scenario", ScenarioTestHandler)
+	http.HandleFunc("/loadtest/stream", StreamLoadTestHandler)
+	http.HandleFunc("/loadtest/cancel", CancelLoadTestHandler)
+	http.HandleFunc("/runs", RunsHandler)
+	http.HandleFunc("/runs/", RunsHandler)
+	http.HandleFunc("/runs/compare", RunCompareHandler)
 
 	server := &http.Server{Addr: ":9012"}
 
 	// Graceful shutdown handling
 	go func() {
 		// Monitor for shutdown signal (e.g., SIGINT, SIGTERM)
-		quit := make(chan os.Signal,1)
+		quit := make(chan os.Signal, 1)
 		signal.Notify(quit, os.Interrupt, os.Interrupt, syscall.SIGTERM)
 		<-quit
 		log.Println("Shutdown signal received, initiating graceful shutdown...")
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// rawBytesCodec lets GRPCProtocol call an arbitrary method descriptor with
+// plain []byte payloads instead of generated proto.Message stubs. grpc-go's
+// default codec only marshals proto.Message and rejects []byte outright, so
+// every call needs this codec selected explicitly via
+// grpc.CallContentSubtype(rawCodecName).
+type rawBytesCodec struct{}
+
+func (rawBytesCodec) Marshal(v interface{}) ([]byte, error) {
+	switch payload := v.(type) {
+	case []byte:
+		return payload, nil
+	case *[]byte:
+		return *payload, nil
+	default:
+		return nil, fmt.Errorf("rawBytesCodec: unsupported type %T", v)
+	}
+}
+
+func (rawBytesCodec) Unmarshal(data []byte, v interface{}) error {
+	payload, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("rawBytesCodec: unsupported type %T", v)
+	}
+	*payload = data
+	return nil
+}
+
+func (rawBytesCodec) Name() string { return rawCodecName }
+
+const rawCodecName = "raw"
+
+func init() {
+	encoding.RegisterCodec(rawBytesCodec{})
+}
+
+// Protocol is a single request/round-trip a worker can drive against a
+// target. Introducing this interface turns the tool from an HTTP-GET
+// benchmarker into a general load generator: a Worker no longer knows
+// whether it's talking HTTP, gRPC, WebSocket, or raw TCP.
+type Protocol interface {
+	// Do performs one request/round-trip and reports the response status
+	// (protocol-specific; e.g. HTTP status code, gRPC code, 0 for protocols
+	// without one), the number of response bytes read, and any error.
+	Do(ctx context.Context) (status int, bytes int64, err error)
+	// Stats reports cumulative bytes in/out and connection reuse counts
+	// across every Do call made against this Protocol instance.
+	Stats() connectionStats
+}
+
+// ProtocolOptions carries the protocol-specific knobs that don't fit the
+// common (name, url, timeout) constructor signature. Only gRPC reads these
+// today; other protocols ignore them.
+type ProtocolOptions struct {
+	// GRPCMethod is the full "/Service/Method" path to invoke, defaulting to
+	// "/LoadTest/Ping" when empty.
+	GRPCMethod string
+	// GRPCStream selects a server-streaming call (reading repeated messages
+	// off the stream until it ends) instead of a single unary request.
+	GRPCStream bool
+}
+
+// newProtocol builds a Protocol for the given name ("http", "http2", "grpc",
+// "websocket", "tcp"), defaulting to HTTP/1.1 when name is empty.
+func newProtocol(name, url string, timeout time.Duration, opts ProtocolOptions) (Protocol, error) {
+	switch name {
+	case "", "http":
+		return NewHTTPProtocol(url, timeout, false), nil
+	case "http2":
+		return NewHTTPProtocol(url, timeout, true), nil
+	case "grpc":
+		return NewGRPCProtocol(url, timeout, opts)
+	case "websocket":
+		return NewWebSocketProtocol(url)
+	case "tcp":
+		return NewTCPProtocol(url, timeout), nil
+	default:
+		return nil, fmt.Errorf("unknown protocol %q", name)
+	}
+}
+
+// connectionStats tracks bytes and connection reuse across every Do call on
+// one Protocol instance, merged into LoadTestMetrics at the end of a run.
+type connectionStats struct {
+	bytesIn  int64
+	bytesOut int64
+	reused   int64
+	new      int64
+}
+
+func (s *connectionStats) recordConn(reused bool) {
+	if reused {
+		atomic.AddInt64(&s.reused, 1)
+	} else {
+		atomic.AddInt64(&s.new, 1)
+	}
+}
+
+// HTTPProtocol issues a single GET per Do call over a shared, pooled
+// *http.Client. http2 selects HTTP/2 with keep-alives and a bounded number
+// of connections per host; plain http uses HTTP/1.1 with the same pooling.
+type HTTPProtocol struct {
+	url    string
+	client *http.Client
+	stats  *connectionStats
+}
+
+func NewHTTPProtocol(url string, timeout time.Duration, useHTTP2 bool) *HTTPProtocol {
+	var transport http.RoundTripper
+	switch {
+	case useHTTP2 && strings.HasPrefix(url, "https://"):
+		transport = &http.Transport{
+			MaxConnsPerHost:     100,
+			MaxIdleConnsPerHost: 100,
+			IdleConnTimeout:     90 * time.Second,
+			ForceAttemptHTTP2:   true,
+			TLSClientConfig:     &tls.Config{NextProtos: []string{"h2", "http/1.1"}},
+		}
+	case useHTTP2:
+		// net/http.Transport can't negotiate HTTP/2 over a plain http://
+		// URL - ALPN only happens during a TLS handshake - so cleartext h2c
+		// needs golang.org/x/net/http2.Transport told to dial straight to
+		// TCP and skip TLS negotiation entirely.
+		transport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		}
+	default:
+		transport = &http.Transport{
+			MaxConnsPerHost:     100,
+			MaxIdleConnsPerHost: 100,
+			IdleConnTimeout:     90 * time.Second,
+		}
+	}
+	return &HTTPProtocol{
+		url:    url,
+		client: &http.Client{Timeout: timeout, Transport: transport},
+		stats:  &connectionStats{},
+	}
+}
+
+func (p *HTTPProtocol) Do(ctx context.Context) (int, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var reused bool
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+	}
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	n, err := io.Copy(io.Discard, resp.Body)
+	p.stats.recordConn(reused)
+	atomic.AddInt64(&p.stats.bytesIn, n)
+	return resp.StatusCode, n, err
+}
+
+func (p *HTTPProtocol) Stats() connectionStats { return *p.stats }
+
+// wsEnvelope wraps every WebSocket message with an ID so a reply read off
+// the shared connection can be routed back to whichever Do call sent it.
+// Reading directly off a shared conn and assuming the next frame belongs to
+// the caller that just wrote is wrong under concurrent Do calls
+// (max_inflight > 1): a worker can easily receive a different worker's
+// reply, silently corrupting every recorded status/latency.
+type wsEnvelope struct {
+	ID      uint64 `json:"id"`
+	Payload string `json:"payload"`
+}
+
+// WebSocketProtocol opens one connection for the whole run (not per Do
+// call - a real client wouldn't reconnect per message either) and
+// correlates concurrent callers by message ID via a single background
+// reader, so multiple in-flight Do calls on the same connection each get
+// their own reply instead of racing on whichever frame comes off the wire
+// next.
+type WebSocketProtocol struct {
+	conn  *websocket.Conn
+	stats *connectionStats
+
+	writeMu sync.Mutex
+	nextID  uint64
+
+	pendingMu sync.Mutex
+	pending   map[uint64]chan []byte
+}
+
+func NewWebSocketProtocol(url string) (*WebSocketProtocol, error) {
+	conn, err := websocket.Dial(url, "", "http://localhost")
+	if err != nil {
+		return nil, fmt.Errorf("dialing websocket %s: %w", url, err)
+	}
+	p := &WebSocketProtocol{
+		conn:    conn,
+		stats:   &connectionStats{},
+		pending: make(map[uint64]chan []byte),
+	}
+	go p.readLoop()
+	return p, nil
+}
+
+// readLoop is the connection's single reader. It dispatches each reply to
+// whichever Do call is waiting on its envelope ID, and exits - failing any
+// still-pending callers - once the connection errors or closes.
+func (p *WebSocketProtocol) readLoop() {
+	for {
+		var raw []byte
+		if err := websocket.Message.Receive(p.conn, &raw); err != nil {
+			p.failPending()
+			return
+		}
+
+		var envelope wsEnvelope
+		if err := json.Unmarshal(raw, &envelope); err != nil {
+			continue
+		}
+
+		p.pendingMu.Lock()
+		ch, ok := p.pending[envelope.ID]
+		if ok {
+			delete(p.pending, envelope.ID)
+		}
+		p.pendingMu.Unlock()
+		if ok {
+			ch <- raw
+		}
+	}
+}
+
+func (p *WebSocketProtocol) failPending() {
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+	for id, ch := range p.pending {
+		close(ch)
+		delete(p.pending, id)
+	}
+}
+
+func (p *WebSocketProtocol) Do(ctx context.Context) (int, int64, error) {
+	id := atomic.AddUint64(&p.nextID, 1)
+	reply := make(chan []byte, 1)
+	p.pendingMu.Lock()
+	p.pending[id] = reply
+	p.pendingMu.Unlock()
+
+	message, err := json.Marshal(wsEnvelope{ID: id, Payload: "ping"})
+	if err != nil {
+		p.pendingMu.Lock()
+		delete(p.pending, id)
+		p.pendingMu.Unlock()
+		return 0, 0, err
+	}
+
+	p.writeMu.Lock()
+	err = websocket.Message.Send(p.conn, message)
+	p.writeMu.Unlock()
+	if err != nil {
+		p.pendingMu.Lock()
+		delete(p.pending, id)
+		p.pendingMu.Unlock()
+		return 0, 0, err
+	}
+	atomic.AddInt64(&p.stats.bytesOut, int64(len(message)))
+
+	select {
+	case raw, ok := <-reply:
+		if !ok {
+			return 0, 0, fmt.Errorf("websocket connection closed while awaiting reply")
+		}
+		atomic.AddInt64(&p.stats.bytesIn, int64(len(raw)))
+		p.stats.recordConn(true) // same connection reused for every message
+		return 0, int64(len(raw)), nil
+	case <-ctx.Done():
+		p.pendingMu.Lock()
+		delete(p.pending, id)
+		p.pendingMu.Unlock()
+		return 0, 0, ctx.Err()
+	}
+}
+
+func (p *WebSocketProtocol) Stats() connectionStats { return *p.stats }
+
+// GRPCProtocol issues one RPC per Do call over a shared *grpc.ClientConn,
+// using the raw codec so it can invoke a method without generated stubs -
+// methodPath (a descriptor path, e.g. "/LoadTest/Ping") identifies which
+// method to call, and stream switches between a single unary request and a
+// server-streaming call that reads messages until the server ends the
+// stream.
+type GRPCProtocol struct {
+	conn       *grpc.ClientConn
+	methodPath string
+	stream     bool
+	stats      *connectionStats
+}
+
+func NewGRPCProtocol(target string, timeout time.Duration, opts ProtocolOptions) (*GRPCProtocol, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, target, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		return nil, fmt.Errorf("dialing grpc target %s: %w", target, err)
+	}
+
+	methodPath := opts.GRPCMethod
+	if methodPath == "" {
+		methodPath = "/LoadTest/Ping"
+	}
+	return &GRPCProtocol{conn: conn, methodPath: methodPath, stream: opts.GRPCStream, stats: &connectionStats{}}, nil
+}
+
+func (p *GRPCProtocol) Do(ctx context.Context) (int, int64, error) {
+	if p.stream {
+		return p.doStream(ctx)
+	}
+
+	var reply []byte
+	err := p.conn.Invoke(ctx, p.methodPath, []byte{}, &reply, grpc.CallContentSubtype(rawCodecName))
+	p.stats.recordConn(true) // grpc.ClientConn pools connections internally
+	if err != nil {
+		return 0, 0, err
+	}
+	atomic.AddInt64(&p.stats.bytesIn, int64(len(reply)))
+	return 0, int64(len(reply)), nil
+}
+
+// doStream opens a server-streaming call against methodPath, sends a single
+// request message, and reads every message the server sends back until it
+// closes the stream with io.EOF.
+func (p *GRPCProtocol) doStream(ctx context.Context) (int, int64, error) {
+	desc := &grpc.StreamDesc{StreamName: p.methodPath, ServerStreams: true}
+	stream, err := p.conn.NewStream(ctx, desc, p.methodPath, grpc.CallContentSubtype(rawCodecName))
+	if err != nil {
+		return 0, 0, err
+	}
+	p.stats.recordConn(true)
+
+	if err := stream.SendMsg([]byte{}); err != nil {
+		return 0, 0, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return 0, 0, err
+	}
+
+	var total int64
+	for {
+		var reply []byte
+		err := stream.RecvMsg(&reply)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, total, err
+		}
+		total += int64(len(reply))
+	}
+	atomic.AddInt64(&p.stats.bytesIn, total)
+	return 0, total, nil
+}
+
+func (p *GRPCProtocol) Stats() connectionStats { return *p.stats }
+
+// TCPProtocol opens a fresh raw TCP connection per Do call, writes a single
+// newline-terminated payload, and does a single read of up to 4096 bytes of
+// response (not necessarily one whole line).
+type TCPProtocol struct {
+	addr    string
+	timeout time.Duration
+	stats   *connectionStats
+}
+
+func NewTCPProtocol(addr string, timeout time.Duration) *TCPProtocol {
+	return &TCPProtocol{addr: addr, timeout: timeout, stats: &connectionStats{}}
+}
+
+func (p *TCPProtocol) Do(ctx context.Context) (int, int64, error) {
+	dialer := net.Dialer{Timeout: p.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	p.stats.recordConn(false)
+
+	payload := []byte("ping\n")
+	if _, err := conn.Write(payload); err != nil {
+		return 0, 0, err
+	}
+	atomic.AddInt64(&p.stats.bytesOut, int64(len(payload)))
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+	atomic.AddInt64(&p.stats.bytesIn, int64(n))
+	return 0, int64(n), nil
+}
+
+func (p *TCPProtocol) Stats() connectionStats { return *p.stats }
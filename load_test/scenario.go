@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Scenario is an ordered, multi-step, multi-endpoint test definition loaded
+// from a YAML or JSON file, used in place of the single `url` parameter for
+// scripted tests that need auth, think-time, and data-driven payloads.
+type Scenario struct {
+	Steps      []Step      `yaml:"steps" json:"steps"`
+	DataSource *DataSource `yaml:"data_source" json:"data_source"`
+}
+
+// Step is one request in a scenario: method/URL/headers/body templates with
+// ${var} interpolation, extractors that bind response fields into variables
+// for later steps, assertions that fail the step, and a think-time delay
+// applied before the step runs. Protocol selects a non-HTTP Protocol
+// implementation (e.g. "grpc", "websocket", "tcp") to drive this step
+// against URL instead of the HTTP-templated path above; Headers/Body/
+// Extract are ignored for those steps, and any JSONPathEqua assertion on
+// them counts as failed, since Protocol only reports a status/byte count,
+// not a body.
+type Step struct {
+	Name       string            `yaml:"name" json:"name"`
+	Method     string            `yaml:"method" json:"method"`
+	URL        string            `yaml:"url" json:"url"`
+	Headers    map[string]string `yaml:"headers" json:"headers"`
+	Body       string            `yaml:"body" json:"body"`
+	Extract    []Extractor       `yaml:"extract" json:"extract"`
+	Assertions []Assertion       `yaml:"assertions" json:"assertions"`
+	ThinkTime  ThinkTime         `yaml:"think_time" json:"think_time"`
+	Protocol   string            `yaml:"protocol" json:"protocol"`
+	GRPCMethod string            `yaml:"grpc_method" json:"grpc_method"`
+	GRPCStream bool              `yaml:"grpc_stream" json:"grpc_stream"`
+}
+
+// Extractor binds a variable from the response body (JSONPath) or the raw
+// response text (Regex) for use in later steps' templates.
+type Extractor struct {
+	Var      string `yaml:"var" json:"var"`
+	JSONPath string `yaml:"json_path" json:"json_path"`
+	Regex    string `yaml:"regex" json:"regex"`
+}
+
+// Assertion checks a property of the step's response. A zero-value field is
+// treated as "not checked".
+type Assertion struct {
+	StatusRegex  string            `yaml:"status_regex" json:"status_regex"`
+	LatencySLO   time.Duration     `yaml:"latency_slo" json:"latency_slo"`
+	JSONPathEqua map[string]string `yaml:"json_path_equals" json:"json_path_equals"`
+}
+
+// ThinkTime models the pause a real user takes between steps.
+type ThinkTime struct {
+	Distribution string  `yaml:"distribution" json:"distribution"` // constant, uniform, normal
+	Value        float64 `yaml:"value" json:"value"`               // seconds, for constant/normal mean
+	Min          float64 `yaml:"min" json:"min"`                   // seconds, for uniform
+	Max          float64 `yaml:"max" json:"max"`                   // seconds, for uniform
+	StdDev       float64 `yaml:"std_dev" json:"std_dev"`           // seconds, for normal
+}
+
+// Sample draws one think-time duration from the configured distribution.
+func (t ThinkTime) Sample() time.Duration {
+	var seconds float64
+	switch t.Distribution {
+	case "uniform":
+		seconds = t.Min + rand.Float64()*(t.Max-t.Min)
+	case "normal":
+		seconds = rand.NormFloat64()*t.StdDev + t.Value
+	default: // "constant" or unset
+		seconds = t.Value
+	}
+	if seconds < 0 {
+		seconds = 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// DataSource seeds scenario variables from a CSV file, one row per virtual
+// user, either assigned round-robin or at random.
+type DataSource struct {
+	File string `yaml:"file" json:"file"`
+	Mode string `yaml:"mode" json:"mode"` // round_robin (default) or random
+
+	rows    []map[string]string
+	rowsM   sync.Mutex
+	nextIdx int
+}
+
+// Load reads the CSV file into memory, using the header row as column names.
+func (d *DataSource) Load() error {
+	file, err := os.Open(d.File)
+	if err != nil {
+		return fmt.Errorf("opening data source %s: %w", d.File, err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(bufio.NewReader(file))
+	records, err := reader.ReadAll()
+	if err != nil {
+		return fmt.Errorf("reading data source %s: %w", d.File, err)
+	}
+	if len(records) < 2 {
+		return nil
+	}
+
+	header := records[0]
+	for _, record := range records[1:] {
+		row := make(map[string]string, len(header))
+		for i, column := range header {
+			if i < len(record) {
+				row[column] = record[i]
+			}
+		}
+		d.rows = append(d.rows, row)
+	}
+	return nil
+}
+
+// Row returns the variables assigned to virtual user vu.
+func (d *DataSource) Row(vu int) map[string]string {
+	if d == nil || len(d.rows) == 0 {
+		return nil
+	}
+	if d.Mode == "random" {
+		return d.rows[rand.Intn(len(d.rows))]
+	}
+
+	d.rowsM.Lock()
+	defer d.rowsM.Unlock()
+	row := d.rows[d.nextIdx%len(d.rows)]
+	d.nextIdx++
+	return row
+}
+
+// LoadScenario reads and parses a scenario file, dispatching on its
+// extension: .yaml/.yml for YAML, everything else as JSON.
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading scenario %s: %w", path, err)
+	}
+
+	var scenario Scenario
+	if strings.HasSuffix(path, ".yaml") || strings.HasSuffix(path, ".yml") {
+		if err := yaml.Unmarshal(data, &scenario); err != nil {
+			return nil, fmt.Errorf("parsing scenario %s as yaml: %w", path, err)
+		}
+	} else {
+		if err := json.Unmarshal(data, &scenario); err != nil {
+			return nil, fmt.Errorf("parsing scenario %s as json: %w", path, err)
+		}
+	}
+
+	if scenario.DataSource != nil && scenario.DataSource.File != "" {
+		if err := scenario.DataSource.Load(); err != nil {
+			return nil, err
+		}
+	}
+	return &scenario, nil
+}
+
+var templateVarPattern = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// interpolate substitutes ${var} placeholders with values from vars,
+// leaving unrecognized placeholders untouched.
+func interpolate(template string, vars map[string]string) string {
+	return templateVarPattern.ReplaceAllStringFunc(template, func(match string) string {
+		name := templateVarPattern.FindStringSubmatch(match)[1]
+		if value, ok := vars[name]; ok {
+			return value
+		}
+		return match
+	})
+}
+
+// StepMetrics aggregates results for a single named step across every
+// virtual user and iteration that ran it.
+type StepMetrics struct {
+	Count          int `json:"count"`
+	Failures       int `json:"failures"`
+	AssertionFails int `json:"assertion_failures"`
+	histogram      *HDRHistogram
+	P50            string `json:"p50"`
+	P95            string `json:"p95"`
+	P99            string `json:"p99"`
+}
+
+// ScenarioResult is the response from running a scenario-based test.
+type ScenarioResult struct {
+	TotalIterations int                     `json:"total_iterations"`
+	PerStep         map[string]*StepMetrics `json:"per_step"`
+}
+
+// extractValue pulls a value out of a response body using either a dotted
+// JSONPath (e.g. "data.id") or a regex with one capture group.
+func extractValue(body []byte, extractor Extractor) (string, bool) {
+	if extractor.Regex != "" {
+		re, err := regexp.Compile(extractor.Regex)
+		if err != nil {
+			return "", false
+		}
+		match := re.FindSubmatch(body)
+		if len(match) < 2 {
+			return "", false
+		}
+		return string(match[1]), true
+	}
+
+	if extractor.JSONPath != "" {
+		var parsed interface{}
+		if err := json.Unmarshal(body, &parsed); err != nil {
+			return "", false
+		}
+		current := parsed
+		for _, field := range strings.Split(extractor.JSONPath, ".") {
+			m, ok := current.(map[string]interface{})
+			if !ok {
+				return "", false
+			}
+			current, ok = m[field]
+			if !ok {
+				return "", false
+			}
+		}
+		return fmt.Sprintf("%v", current), true
+	}
+
+	return "", false
+}
+
+// checkAssertions evaluates every assertion for a step's response, returning
+// the number that failed.
+func checkAssertions(assertions []Assertion, status int, latency time.Duration, body []byte) int {
+	failures := 0
+	for _, assertion := range assertions {
+		if assertion.StatusRegex != "" {
+			re, err := regexp.Compile(assertion.StatusRegex)
+			if err != nil || !re.MatchString(strconv.Itoa(status)) {
+				failures++
+				continue
+			}
+		}
+		if assertion.LatencySLO > 0 && latency > assertion.LatencySLO {
+			failures++
+			continue
+		}
+		for path, expected := range assertion.JSONPathEqua {
+			actual, ok := extractValue(body, Extractor{JSONPath: path})
+			if !ok || actual != expected {
+				failures++
+			}
+		}
+	}
+	return failures
+}
+
+// runStep executes one scenario step, updating vars with any extracted
+// values and returning the status, latency, and number of assertion
+// failures for the step metrics. proto is non-nil for steps with a
+// non-HTTP Protocol, in which case the HTTP templating below is skipped
+// entirely in favor of a single Protocol.Do call.
+func runStep(client *http.Client, step Step, vars map[string]string, proto Protocol) (status int, latency time.Duration, assertionFailures int, err error) {
+	if wait := step.ThinkTime.Sample(); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	if proto != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), client.Timeout)
+		defer cancel()
+
+		start := time.Now()
+		status, _, err = proto.Do(ctx)
+		latency = time.Since(start)
+		if err != nil {
+			return status, latency, 0, err
+		}
+		return status, latency, checkAssertions(step.Assertions, status, latency, nil), nil
+	}
+
+	url := interpolate(step.URL, vars)
+	var bodyReader io.Reader
+	if step.Body != "" {
+		bodyReader = bytes.NewBufferString(interpolate(step.Body, vars))
+	}
+
+	method := step.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequest(method, url, bodyReader)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	for key, value := range step.Headers {
+		req.Header.Set(key, interpolate(value, vars))
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	latency = time.Since(start)
+	if err != nil {
+		return 0, latency, 0, err
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, latency, 0, err
+	}
+
+	for _, extractor := range step.Extract {
+		if value, ok := extractValue(responseBody, extractor); ok {
+			vars[extractor.Var] = value
+		}
+	}
+
+	return resp.StatusCode, latency, checkAssertions(step.Assertions, resp.StatusCode, latency, responseBody), nil
+}
+
+// ScenarioTestHandler runs a scenario-based test: one goroutine per virtual
+// user (the vus query parameter, default 1), each iterating the scenario's steps in order for duration seconds,
+// with metrics aggregated per step name.
+func ScenarioTestHandler(w http.ResponseWriter, r *http.Request) {
+	virtualUsers, err := strconv.Atoi(r.URL.Query().Get("vus"))
+	if err != nil || virtualUsers <= 0 {
+		virtualUsers = 1
+	}
+	duration, err := strconv.Atoi(r.URL.Query().Get("duration"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var scenario *Scenario
+	if r.Method == http.MethodPost {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		scenario = &Scenario{}
+		if err := json.Unmarshal(body, scenario); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if scenario.DataSource != nil && scenario.DataSource.File != "" {
+			if err := scenario.DataSource.Load(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	} else {
+		scenarioPath := r.URL.Query().Get("scenario")
+		if scenarioPath == "" {
+			http.Error(w, "scenario query parameter or POST body is required", http.StatusBadRequest)
+			return
+		}
+		scenario, err = LoadScenario(scenarioPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	client := &http.Client{Timeout: time.Duration(duration) * time.Second}
+	deadline := time.Now().Add(time.Duration(duration) * time.Second)
+
+	perStep := make(map[string]*StepMetrics, len(scenario.Steps))
+	var perStepM sync.Mutex
+	for _, step := range scenario.Steps {
+		perStep[step.Name] = &StepMetrics{histogram: newLatencyHistogram()}
+	}
+
+	// Steps with a non-HTTP Protocol share one Protocol instance across every
+	// VU and iteration, the same pooling startLoadTest relies on.
+	stepProtocols := make(map[string]Protocol, len(scenario.Steps))
+	for _, step := range scenario.Steps {
+		if step.Protocol == "" || step.Protocol == "http" {
+			continue
+		}
+		opts := ProtocolOptions{GRPCMethod: step.GRPCMethod, GRPCStream: step.GRPCStream}
+		proto, err := newProtocol(step.Protocol, step.URL, time.Duration(duration)*time.Second, opts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		stepProtocols[step.Name] = proto
+	}
+
+	var totalIterations int64
+	wg := &sync.WaitGroup{}
+	for vu := 0; vu < virtualUsers; vu++ {
+		wg.Add(1)
+		go func(vu int) {
+			defer wg.Done()
+			vars := make(map[string]string)
+			for key, value := range scenario.DataSource.Row(vu) {
+				vars[key] = value
+			}
+
+			for time.Now().Before(deadline) {
+				for _, step := range scenario.Steps {
+					status, latency, assertionFailures, err := runStep(client, step, vars, stepProtocols[step.Name])
+
+					perStepM.Lock()
+					metrics := perStep[step.Name]
+					metrics.Count++
+					if err != nil || status >= 400 {
+						metrics.Failures++
+					}
+					metrics.AssertionFails += assertionFailures
+					metrics.histogram.Record(latency)
+					perStepM.Unlock()
+				}
+				atomic.AddInt64(&totalIterations, 1)
+			}
+		}(vu)
+	}
+	wg.Wait()
+
+	for _, metrics := range perStep {
+		metrics.P50 = metrics.histogram.Percentile(50).String()
+		metrics.P95 = metrics.histogram.Percentile(95).String()
+		metrics.P99 = metrics.histogram.Percentile(99).String()
+	}
+
+	result := ScenarioResult{TotalIterations: int(totalIterations), PerStep: perStep}
+	responseJSON, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+)
+
+// Run is one completed load test: its parameters and the resulting metrics,
+// addressable by a stable RunID so later requests can compare it against
+// other runs against the same target.
+type Run struct {
+	RunID     string            `json:"run_id"`
+	StartedAt time.Time         `json:"started_at"`
+	URL       string            `json:"url"`
+	Params    map[string]string `json:"params"`
+	Metrics   LoadTestMetrics   `json:"metrics"`
+}
+
+// ResultStore persists completed runs and makes them queryable by ID or by
+// target URL, replacing the old append-only metrics.csv.
+type ResultStore interface {
+	Save(run Run) error
+	Get(runID string) (Run, error)
+	ListByURL(url string, limit int) ([]Run, error)
+}
+
+// resultStore is selected once at startup via RESULT_STORE_BACKEND
+// ("csv" (default), "redis", "mysql").
+var resultStore ResultStore
+
+// newResultStore builds the configured backend, falling back to CSV if the
+// requested backend isn't available.
+func newResultStore() ResultStore {
+	switch os.Getenv("RESULT_STORE_BACKEND") {
+	case "redis":
+		if err := ensureRedisConnected(); err != nil {
+			fmt.Println("Falling back to CSV result store:", err)
+			return &CSVResultStore{path: "runs.csv"}
+		}
+		return &RedisResultStore{}
+	case "mysql":
+		store, err := NewMySQLResultStore()
+		if err != nil {
+			fmt.Println("Falling back to CSV result store:", err)
+			return &CSVResultStore{path: "runs.csv"}
+		}
+		return store
+	default:
+		return &CSVResultStore{path: "runs.csv"}
+	}
+}
+
+// CSVResultStore appends one JSON-encoded run per row to a CSV file and
+// scans the whole file to answer Get/ListByURL - adequate for the single-
+// node deployments this tool started out supporting.
+type CSVResultStore struct {
+	path string
+}
+
+func (s *CSVResultStore) Save(run Run) error {
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	runJSON, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+	return writer.Write([]string{run.RunID, run.URL, run.StartedAt.Format(time.RFC3339), string(runJSON)})
+}
+
+func (s *CSVResultStore) readAll() ([]Run, error) {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	var runs []Run
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var run Run
+		if err := json.Unmarshal([]byte(record[3]), &run); err != nil {
+			continue
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+func (s *CSVResultStore) Get(runID string) (Run, error) {
+	runs, err := s.readAll()
+	if err != nil {
+		return Run{}, err
+	}
+	for _, run := range runs {
+		if run.RunID == runID {
+			return run, nil
+		}
+	}
+	return Run{}, fmt.Errorf("run %s not found", runID)
+}
+
+func (s *CSVResultStore) ListByURL(url string, limit int) ([]Run, error) {
+	runs, err := s.readAll()
+	if err != nil {
+		return nil, err
+	}
+	var matched []Run
+	for _, run := range runs {
+		if run.URL == url {
+			matched = append(matched, run)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].StartedAt.After(matched[j].StartedAt) })
+	if limit > 0 && len(matched) > limit {
+		matched = matched[:limit]
+	}
+	return matched, nil
+}
+
+// RedisResultStore keeps a sorted set per target URL (score = run start
+// time) alongside a JSON blob per run, reusing the connection pattern and
+// env-var setup the sibling book service and the distributed agent both
+// use.
+type RedisResultStore struct{}
+
+func runKey(runID string) string {
+	return "loadtest:run:" + runID
+}
+
+func runsByURLKey(url string) string {
+	return "loadtest:runs:" + url
+}
+
+func (s *RedisResultStore) Save(run Run) error {
+	runJSON, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	if err := RedisClient.Set(redisCtx, runKey(run.RunID), runJSON, 0).Err(); err != nil {
+		return err
+	}
+	return RedisClient.ZAdd(redisCtx, runsByURLKey(run.URL), &redis.Z{
+		Score:  float64(run.StartedAt.Unix()),
+		Member: run.RunID,
+	}).Err()
+}
+
+func (s *RedisResultStore) Get(runID string) (Run, error) {
+	data, err := RedisClient.Get(redisCtx, runKey(runID)).Result()
+	if err != nil {
+		return Run{}, fmt.Errorf("run %s not found: %w", runID, err)
+	}
+	var run Run
+	if err := json.Unmarshal([]byte(data), &run); err != nil {
+		return Run{}, err
+	}
+	return run, nil
+}
+
+func (s *RedisResultStore) ListByURL(url string, limit int) ([]Run, error) {
+	if limit <= 0 {
+		limit = 20
+	}
+	ids, err := RedisClient.ZRevRange(redisCtx, runsByURLKey(url), 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var runs []Run
+	for _, id := range ids {
+		run, err := s.Get(id)
+		if err != nil {
+			continue
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+// MySQLResultStore stores runs in a `runs` table, reusing the
+// DBUsername/DBPassword/DBHost/DBPort/DBName environment variables the
+// sibling book service connects with.
+type MySQLResultStore struct {
+	db *sql.DB
+}
+
+func NewMySQLResultStore() (*MySQLResultStore, error) {
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
+		os.Getenv("DBUsername"), os.Getenv("DBPassword"), os.Getenv("DBHost"), os.Getenv("DBPort"), os.Getenv("DBName"))
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS runs (
+		run_id VARCHAR(64) PRIMARY KEY,
+		url TEXT,
+		started_at DATETIME,
+		run_json LONGTEXT
+	)`); err != nil {
+		return nil, err
+	}
+	return &MySQLResultStore{db: db}, nil
+}
+
+func (s *MySQLResultStore) Save(run Run) error {
+	runJSON, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT INTO runs (run_id, url, started_at, run_json) VALUES (?, ?, ?, ?)",
+		run.RunID, run.URL, run.StartedAt, string(runJSON))
+	return err
+}
+
+func (s *MySQLResultStore) Get(runID string) (Run, error) {
+	row := s.db.QueryRow("SELECT run_json FROM runs WHERE run_id = ?", runID)
+	var runJSON string
+	if err := row.Scan(&runJSON); err != nil {
+		return Run{}, err
+	}
+	var run Run
+	if err := json.Unmarshal([]byte(runJSON), &run); err != nil {
+		return Run{}, err
+	}
+	return run, nil
+}
+
+func (s *MySQLResultStore) ListByURL(url string, limit int) ([]Run, error) {
+	if limit <= 0 {
+		limit = 20
+	}
+	rows, err := s.db.Query("SELECT run_json FROM runs WHERE url = ? ORDER BY started_at DESC LIMIT ?", url, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []Run
+	for rows.Next() {
+		var runJSON string
+		if err := rows.Scan(&runJSON); err != nil {
+			continue
+		}
+		var run Run
+		if err := json.Unmarshal([]byte(runJSON), &run); err != nil {
+			continue
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+// RunsHandler serves GET /runs?url=... (list) and GET /runs/{id} (one run).
+func RunsHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/runs/")
+	if id != "" && id != r.URL.Path {
+		run, err := resultStore.Get(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, run)
+		return
+	}
+
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		http.Error(w, "url query parameter is required", http.StatusBadRequest)
+		return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	runs, err := resultStore.ListByURL(url, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, runs)
+}
+
+// RunComparison is the delta between two runs against the same (or
+// different) targets, so a deploy can be regression-tested against a prior
+// baseline.
+type RunComparison struct {
+	RunA             Run         `json:"run_a"`
+	RunB             Run         `json:"run_b"`
+	DeltaP50         string      `json:"delta_p50"`
+	DeltaP95         string      `json:"delta_p95"`
+	DeltaP99         string      `json:"delta_p99"`
+	ErrorRateChange  float64     `json:"error_rate_change"`
+	ThroughputChange int         `json:"throughput_change"`
+	StatusCodeDeltas map[int]int `json:"status_code_deltas"`
+}
+
+// RunCompareHandler serves GET /runs/compare?a=<id>&b=<id>.
+func RunCompareHandler(w http.ResponseWriter, r *http.Request) {
+	aID := r.URL.Query().Get("a")
+	bID := r.URL.Query().Get("b")
+	if aID == "" || bID == "" {
+		http.Error(w, "a and b query parameters are required", http.StatusBadRequest)
+		return
+	}
+
+	runA, err := resultStore.Get(aID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	runB, err := resultStore.Get(bID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	deltaP50, _ := durationDelta(runA.Metrics.P50, runB.Metrics.P50)
+	deltaP95, _ := durationDelta(runA.Metrics.P95, runB.Metrics.P95)
+	deltaP99, _ := durationDelta(runA.Metrics.P99, runB.Metrics.P99)
+
+	statusDeltas := make(map[int]int)
+	for status, metrics := range runB.Metrics.ResStatusMetrics {
+		statusDeltas[status] += metrics.Count
+	}
+	for status, metrics := range runA.Metrics.ResStatusMetrics {
+		statusDeltas[status] -= metrics.Count
+	}
+
+	comparison := RunComparison{
+		RunA:             runA,
+		RunB:             runB,
+		DeltaP50:         deltaP50.String(),
+		DeltaP95:         deltaP95.String(),
+		DeltaP99:         deltaP99.String(),
+		ErrorRateChange:  runB.Metrics.ErrorRate - runA.Metrics.ErrorRate,
+		ThroughputChange: runB.Metrics.RequestsPerSecond - runA.Metrics.RequestsPerSecond,
+		StatusCodeDeltas: statusDeltas,
+	}
+	writeJSON(w, comparison)
+}
+
+func durationDelta(a, b string) (time.Duration, error) {
+	da, err := time.ParseDuration(a)
+	if err != nil {
+		return 0, err
+	}
+	db, err := time.ParseDuration(b)
+	if err != nil {
+		return 0, err
+	}
+	return db - da, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	responseJSON, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(responseJSON)
+}
+
+// newRunID generates a stable identifier for a completed run.
+func newRunID() string {
+	return uuid.NewString()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// runCancelFuncs holds the cancel function for every run currently in
+// flight, keyed by run_id, so /loadtest/cancel can stop a run started by
+// either LoadTestHandler or StreamLoadTestHandler from a separate request.
+var (
+	runCancelFuncs   = make(map[string]context.CancelFunc)
+	runCancelFuncsMu sync.Mutex
+)
+
+func registerRunCancel(runID string, cancel context.CancelFunc) {
+	runCancelFuncsMu.Lock()
+	runCancelFuncs[runID] = cancel
+	runCancelFuncsMu.Unlock()
+}
+
+func unregisterRunCancel(runID string) {
+	runCancelFuncsMu.Lock()
+	delete(runCancelFuncs, runID)
+	runCancelFuncsMu.Unlock()
+}
+
+// CancelLoadTestHandler serves GET /loadtest/cancel?run_id=..., stopping a
+// run that is still in flight by invoking its stored context.CancelFunc.
+func CancelLoadTestHandler(w http.ResponseWriter, r *http.Request) {
+	runID := r.URL.Query().Get("run_id")
+	if runID == "" {
+		http.Error(w, "run_id query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	runCancelFuncsMu.Lock()
+	cancel, ok := runCancelFuncs[runID]
+	runCancelFuncsMu.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("no running test with run_id %s", runID), http.StatusNotFound)
+		return
+	}
+
+	cancel()
+	writeJSON(w, map[string]string{"run_id": runID, "status": "cancelling"})
+}
+
+// StreamLoadTestHandler serves GET /loadtest/stream with the same query
+// parameters as /loadtest, but instead of blocking for the whole duration
+// it returns immediately and streams one "progress" SSE event per second
+// with the MetricsAggregator's rolling counters, followed by a final
+// "summary" event equivalent to what /loadtest returns.
+func StreamLoadTestHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	url := r.URL.Query().Get("url")
+	rps, err := strconv.Atoi(r.URL.Query().Get("rps"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	duration, err := strconv.Atoi(r.URL.Query().Get("duration"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rampFrom, _ := strconv.Atoi(r.URL.Query().Get("ramp_from"))
+	maxInflight, err := strconv.Atoi(r.URL.Query().Get("max_inflight"))
+	if err != nil || maxInflight <= 0 {
+		maxInflight = rps
+		if maxInflight <= 0 {
+			maxInflight = 1
+		}
+	}
+
+	profile, err := newLoadProfile(r.URL.Query().Get("profile"), rps, rampFrom)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	estimator := r.URL.Query().Get("estimator")
+	protocolName := r.URL.Query().Get("protocol")
+	protocolOpts := ProtocolOptions{
+		GRPCMethod: r.URL.Query().Get("grpc_method"),
+		GRPCStream: r.URL.Query().Get("grpc_stream") == "true",
+	}
+
+	runID := newRunID()
+	ctx, cancel := context.WithCancel(r.Context())
+	registerRunCancel(runID, cancel)
+	defer unregisterRunCancel(runID)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	writeSSEEvent(w, flusher, "init", map[string]string{"run_id": runID})
+
+	startedAt := time.Now()
+	aggregator, done, protocol := startLoadTest(ctx, url, rps, duration, maxInflight, profile, estimator, protocolName, protocolOpts)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+streamLoop:
+	for {
+		select {
+		case <-done:
+			break streamLoop
+		case <-ticker.C:
+			writeSSEEvent(w, flusher, "progress", aggregator.Progress())
+		}
+	}
+
+	metrics := aggregator.Snapshot(rps)
+	metrics.Protocol = protocolName
+	if protocol != nil {
+		stats := protocol.Stats()
+		metrics.BytesIn = stats.bytesIn
+		metrics.BytesOut = stats.bytesOut
+		metrics.ConnectionsReused = stats.reused
+		metrics.ConnectionsNew = stats.new
+	}
+
+	run := Run{
+		RunID:     runID,
+		StartedAt: startedAt,
+		URL:       url,
+		Params: map[string]string{
+			"rps":      strconv.Itoa(rps),
+			"duration": strconv.Itoa(duration),
+			"profile":  r.URL.Query().Get("profile"),
+			"protocol": protocolName,
+		},
+		Metrics: metrics,
+	}
+	if err := resultStore.Save(run); err != nil {
+		fmt.Println("Error saving run:", err)
+	}
+
+	writeSSEEvent(w, flusher, "summary", run)
+}
+
+// writeSSEEvent writes one "event: <name>\ndata: <json>\n\n" frame and
+// flushes it immediately so the client sees it without buffering delay.
+func writeSSEEvent(w http.ResponseWriter, flusher http.Flusher, event string, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		fmt.Println("Error marshaling SSE event:", err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	flusher.Flush()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// Centroid is a single compressed point in a t-digest: the mean of all
+// samples merged into it, and how many samples that represents.
+type Centroid struct {
+	Mean   float64
+	Weight float64
+}
+
+// TDigest is a streaming percentile estimator that stays accurate in the
+// tails even under heavy compression, which makes it a better fit than the
+// HDRHistogram for very skewed latency distributions (e.g. P999 under a
+// long-tailed dependency). Compression is controlled by delta: larger
+// values keep more centroids (more accuracy, more memory).
+type TDigest struct {
+	mu        sync.Mutex
+	delta     float64
+	centroids []Centroid
+	count     float64
+}
+
+// NewTDigest creates a t-digest with the given compression factor. A delta
+// of around 100 is a reasonable default.
+func NewTDigest(delta float64) *TDigest {
+	if delta <= 0 {
+		delta = 100
+	}
+	return &TDigest{delta: delta}
+}
+
+// scale is the k-scale function from Dunning's t-digest paper: it maps a
+// quantile q to a scale value, with k spaced so that centroids near 0 and 1
+// (the tails) are forced smaller, and centroids near 0.5 can be larger.
+func (t *TDigest) scale(q float64) float64 {
+	return (t.delta / (2 * math.Pi)) * math.Asin(2*q-1)
+}
+
+// Insert adds a single sample to the digest, merging it into the nearest
+// centroid if doing so keeps that centroid's weight within the scale-function
+// bound, or creating a new centroid otherwise.
+func (t *TDigest) Insert(x float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.count++
+	if len(t.centroids) == 0 {
+		t.centroids = append(t.centroids, Centroid{Mean: x, Weight: 1})
+		return
+	}
+
+	// Find the nearest centroid by mean.
+	idx := sort.Search(len(t.centroids), func(i int) bool {
+		return t.centroids[i].Mean >= x
+	})
+	best := idx
+	if best == len(t.centroids) {
+		best = len(t.centroids) - 1
+	} else if best > 0 {
+		if math.Abs(t.centroids[best-1].Mean-x) < math.Abs(t.centroids[best].Mean-x) {
+			best = best - 1
+		}
+	}
+
+	// A centroid may absorb the new point only if doing so keeps its k-scale
+	// span - how much of the quantile range [0,1] it covers, as measured by
+	// the asin-based scale() function - within 1. Unlike a flat q(1-q)
+	// weight bound, scale()'s derivative blows up near q=0/1, so tail
+	// centroids are forced to stay small (and split into new centroids
+	// quickly) no matter how large t.count grows; only centroids near the
+	// median, where samples are least interesting, are allowed to absorb
+	// the bulk of the count.
+	cumBefore := t.cumWeightBefore(best)
+	q1 := cumBefore / t.count
+	q2 := (cumBefore + t.centroids[best].Weight + 1) / t.count
+	if t.count <= 1 || t.scale(q2)-t.scale(q1) <= 1 {
+		c := &t.centroids[best]
+		c.Mean += (x - c.Mean) / (c.Weight + 1)
+		c.Weight++
+		return
+	}
+
+	// Insert a new centroid in sorted position.
+	t.centroids = append(t.centroids, Centroid{})
+	copy(t.centroids[idx+1:], t.centroids[idx:])
+	t.centroids[idx] = Centroid{Mean: x, Weight: 1}
+}
+
+// cumWeightBefore returns the total weight of every centroid before index i,
+// used to find where a candidate centroid sits in the cumulative quantile
+// range ahead of deciding whether it can absorb another point.
+func (t *TDigest) cumWeightBefore(i int) float64 {
+	var cumulative float64
+	for j := 0; j < i; j++ {
+		cumulative += t.centroids[j].Weight
+	}
+	return cumulative
+}
+
+// Merge folds another digest's centroids into this one by re-inserting each
+// centroid's mean, weighted by its count. This is an approximation (a true
+// t-digest merge interleaves centroid lists directly) but is simple and
+// adequate for combining per-worker digests at the end of a run.
+func (t *TDigest) Merge(other *TDigest) {
+	if other == nil {
+		return
+	}
+	other.mu.Lock()
+	centroids := make([]Centroid, len(other.centroids))
+	copy(centroids, other.centroids)
+	other.mu.Unlock()
+
+	for _, c := range centroids {
+		for i := 0; i < int(c.Weight); i++ {
+			t.Insert(c.Mean)
+		}
+	}
+}
+
+// Quantile walks the cumulative centroid weights and linearly interpolates
+// between the two centroids surrounding q.
+func (t *TDigest) Quantile(q float64) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.centroids) == 0 {
+		return 0
+	}
+	if len(t.centroids) == 1 {
+		return t.centroids[0].Mean
+	}
+
+	target := q * t.count
+	var cumulative float64
+	for i, c := range t.centroids {
+		next := cumulative + c.Weight
+		if next >= target || i == len(t.centroids)-1 {
+			if i == 0 {
+				return c.Mean
+			}
+			prev := t.centroids[i-1]
+			// Interpolate between the previous and current centroid mean.
+			span := next - cumulative
+			if span == 0 {
+				return c.Mean
+			}
+			frac := (target - cumulative) / span
+			return prev.Mean + frac*(c.Mean-prev.Mean)
+		}
+		cumulative = next
+	}
+	return t.centroids[len(t.centroids)-1].Mean
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"testing"
+)
+
+func percentileOfFloats(samples []float64, percentile float64) float64 {
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+	idx := int(math.Ceil(percentile/100*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+// TestTDigestTailAccuracy checks that the t-digest keeps tail quantiles
+// close to their true values on a long-tailed distribution. Before the fix
+// in 01578a9, the merge-weight bound grew with the running sample count
+// instead of the k-scale function, collapsing the whole tail into a single
+// oversized centroid and putting P999/P9999 over 2x off.
+func TestTDigestTailAccuracy(t *testing.T) {
+	td := NewTDigest(100)
+
+	// Deterministic exponential-ish long tail via inverse-CDF sampling from a
+	// simple xorshift64 PRNG, so the test has no external dependency on
+	// math/rand's seeding behavior.
+	var samples []float64
+	rng := uint64(98765)
+	for i := 0; i < 100000; i++ {
+		rng ^= rng << 13
+		rng ^= rng >> 7
+		rng ^= rng << 17
+		u := float64(rng%1_000_000)/1_000_000 + 1e-9
+		x := -10 * math.Log(u) // exponential with mean 10
+		samples = append(samples, x)
+		td.Insert(x)
+	}
+
+	var maxWeight float64
+	for _, c := range td.centroids {
+		if c.Weight > maxWeight {
+			maxWeight = c.Weight
+		}
+	}
+	if maxWeight > float64(len(samples))/10 {
+		t.Errorf("largest centroid weight %v absorbed over 10%% of all samples (%d) - tail is collapsing", maxWeight, len(samples))
+	}
+
+	for _, p := range []float64{50, 99, 99.9} {
+		got := td.Quantile(p / 100)
+		want := percentileOfFloats(samples, p)
+		relErr := math.Abs(got-want) / want
+		if relErr > 0.2 {
+			t.Errorf("p%v: got %.2f, want ~%.2f (relative error %.4f)", p, got, want, relErr)
+		}
+	}
+}
+
+// TestTDigestMerge checks that merging two digests produces a median close
+// to the combined raw sample median.
+func TestTDigestMerge(t *testing.T) {
+	a := NewTDigest(100)
+	b := NewTDigest(100)
+	var all []float64
+	for i := 1; i <= 1000; i++ {
+		x := float64(i)
+		a.Insert(x)
+		all = append(all, x)
+	}
+	for i := 1001; i <= 2000; i++ {
+		x := float64(i)
+		b.Insert(x)
+		all = append(all, x)
+	}
+	a.Merge(b)
+
+	got := a.Quantile(0.5)
+	want := percentileOfFloats(all, 50)
+	if relErr := math.Abs(got-want) / want; relErr > 0.05 {
+		t.Errorf("merged median = %.2f, want ~%.2f (relative error %.4f)", got, want, relErr)
+	}
+}